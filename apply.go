@@ -0,0 +1,81 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type ApplyOptions struct {
+	FromDevId   int                              // DevID of snapshot, which contained in target. Patch must be created from it.
+	TargetSize  int64                            // size of target, bytes
+	DeleteRange func(offset, length int64) error // apply DELETE records, nil mean skip them. See NewRangeDeleter.
+	ZeroRange   func(offset, length int64) error // apply ZERO records, nil mean write zeros to target. See NewRangeZeroer.
+	Key         *Key                             // key for decrypt data of encrypted patch
+}
+
+// Read patch stream, created by WritePatch, and write changed data to target.
+// Patch is refused if it doesn't match target.
+func ApplyPatch(ctx context.Context, reader io.Reader, target io.WriterAt, opts ApplyOptions) error {
+	patchReader, err := newPatchReader(reader, opts.Key)
+	if err != nil {
+		return err
+	}
+	if patchReader.Header.Encryption != "" && patchReader.cipher == nil {
+		// Records of encrypted patch are authenticated by key only
+		return &PatchError{Err: errors.New("Patch is encrypted, key is needed for apply it")}
+	}
+	err = patchReader.Header.checkTarget(opts.FromDevId, opts.TargetSize)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		patch, err := patchReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch patch.Operation {
+		case NONE:
+			// pass
+		case DELETE:
+			if opts.DeleteRange == nil {
+				continue
+			}
+			err = opts.DeleteRange(patch.Offset, patch.Length)
+			if err != nil {
+				return &OutputWriteError{Err: err}
+			}
+		case ZERO:
+			if opts.ZeroRange == nil {
+				err = zeroRange(target, patch.Offset, patch.Length)
+			} else {
+				err = opts.ZeroRange(patch.Offset, patch.Length)
+			}
+			if err != nil {
+				return &OutputWriteError{Err: err}
+			}
+		case WRITE:
+			err = patchReader.ReadData(patch, func(offset int64, buf []byte) error {
+				_, err := target.WriteAt(buf, offset)
+				if err != nil {
+					return &OutputWriteError{Err: fmt.Errorf("Can't write data to offset %v: %v", offset, err)}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			return &PatchError{Err: fmt.Errorf("Unknown patch operation: %v", patch.Operation)}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+type memWriterAt []byte
+
+func (this memWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	return copy(this[off:], p), nil
+}
+
+func TestApplyPatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, _ := newPatchWriter(buf, newPatchHeader(1, 1, 2, 12), nil)
+	w.WritePatch(Patch{Operation: NONE})
+	w.WritePatch(Patch{Operation: WRITE, Offset: 2, Length: 5})
+	w.WriteData([]byte("abc"))
+	w.WriteData([]byte("de"))
+	w.WritePatch(Patch{Operation: DELETE, Offset: 8, Length: 2})
+	w.WritePatch(Patch{Operation: WRITE, Offset: 10, Length: 1})
+	w.WriteData([]byte("f"))
+	w.Close()
+
+	target := memWriterAt("xxxxxxxxxxxx")
+	deleteRange := func(offset, length int64) error {
+		return zeroRange(target, offset, length)
+	}
+	err := ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: 1, TargetSize: int64(len(target)), DeleteRange: deleteRange})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []byte("xxabcdex\x00\x00fx")
+	if !bytes.Equal(target, expected) {
+		t.Errorf("%q != %q", target, expected)
+	}
+
+	// Data buffer longer then record
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 12), nil)
+	w.WritePatch(Patch{Operation: WRITE, Offset: 0, Length: 2})
+	w.WriteData([]byte("abc"))
+	w.Close()
+	if ApplyPatch(context.Background(), buf, make(memWriterAt, 12), ApplyOptions{FromDevId: 1, TargetSize: 12}) == nil {
+		t.Error()
+	}
+
+	// Truncated stream
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 12), nil)
+	w.WritePatch(Patch{Operation: WRITE, Offset: 0, Length: 5})
+	w.WriteData([]byte("abc"))
+	if err = ApplyPatch(context.Background(), buf, make(memWriterAt, 12), ApplyOptions{FromDevId: 1, TargetSize: 12}); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+
+	// Wrong base snapshot
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 12), nil)
+	w.Close()
+	if ApplyPatch(context.Background(), buf, make(memWriterAt, 12), ApplyOptions{FromDevId: 3, TargetSize: 12}) == nil {
+		t.Error()
+	}
+
+	// Small target
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 12), nil)
+	w.Close()
+	if ApplyPatch(context.Background(), buf, make(memWriterAt, 10), ApplyOptions{FromDevId: 1, TargetSize: 10}) == nil {
+		t.Error()
+	}
+}
+
+func TestApplyPatchBrokenRecord(t *testing.T) {
+	deletePatch := func(offset int64) []byte {
+		buf := &bytes.Buffer{}
+		w, _ := newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+		w.WritePatch(Patch{Operation: DELETE, Offset: offset, Length: 10})
+		w.Close()
+		return buf.Bytes()
+	}
+
+	// Bit flip in offset of record, checksum of record isn't changed
+	broken := deletePatch(20)
+	other := deletePatch(21)
+	for i := range broken {
+		if broken[i] != other[i] {
+			broken[i] = other[i]
+			break
+		}
+	}
+	deleteRange := func(offset, length int64) error {
+		t.Error("Broken record applied", offset, length)
+		return nil
+	}
+	err := ApplyPatch(context.Background(), bytes.NewReader(broken), make(memWriterAt, 100), ApplyOptions{FromDevId: 1, TargetSize: 100, DeleteRange: deleteRange})
+	if exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+}
+
+func TestApplyPatchBadRecord(t *testing.T) {
+	for _, patch := range []Patch{
+		{Operation: ZERO, Offset: 0, Length: -1},
+		{Operation: DELETE, Offset: -10, Length: 20},
+		{Operation: DELETE, Offset: 10, Length: 0},
+		{Operation: WRITE, Offset: 100, Length: 3},
+		{Operation: ZERO, Offset: 90, Length: 20},
+	} {
+		buf := &bytes.Buffer{}
+		w, _ := newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+		w.WritePatch(patch)
+		w.Close()
+		deleteRange := func(offset, length int64) error {
+			t.Error("Bad record applied", offset, length)
+			return nil
+		}
+		err := ApplyPatch(context.Background(), buf, make(memWriterAt, 100), ApplyOptions{FromDevId: 1, TargetSize: 100, DeleteRange: deleteRange})
+		if exitCode(err) != EXIT_PATCH {
+			t.Error(patch, err)
+		}
+	}
+}
@@ -5,42 +5,85 @@ import (
 	"sort"
 )
 
-type dataBlock struct {
+// Mapping of continuous range of thin device to pool data device. All values in bytes.
+type Block struct {
 	OriginOffset int64
 	DataOffset   int64
 	Length       int64
+	Time         int64 // pool time (snapshot counter) when data was written
 }
 
-func (this *dataBlock) IsEmpty() bool {
+func (this *Block) IsEmpty() bool {
 	if this == nil {
 		return true
 	}
-	return *this == dataBlock{}
+	return *this == Block{}
 }
 
 // Offset for next then last byte of origin data
-func (this *dataBlock) OriginLast() int64 {
+func (this *Block) OriginLast() int64 {
 	return this.OriginOffset + this.Length
 }
 
-func (this *dataBlock) Split(length int64) (left, right dataBlock) {
+func (this *Block) Split(length int64) (left, right Block) {
 	if length >= this.Length {
 		left = *this
 	} else {
 		left.DataOffset = this.DataOffset
 		left.OriginOffset = this.OriginOffset
 		left.Length = length
+		left.Time = this.Time
 	}
 
 	right.DataOffset = left.DataOffset + left.Length
 	right.OriginOffset = left.OriginOffset + left.Length
 	right.Length = this.Length - left.Length
+	right.Time = this.Time
 	return left, right
 }
 
-type dataDevice struct {
-	Id        int
-	Blocks    blockArr
+// dev_id of empty device without blocks, for diff from/to nothing
+const NONE_DEV_ID = -1
+
+// Thin device
+type Device struct {
+	Id           int
+	MappedBlocks int64 // count of mapped data blocks
+	Transaction  int64 // transaction id of last change of device
+	CreationTime int64 // pool time when device created
+	SnapTime     int64 // pool time when last snapshot of device created
+	Blocks       BlockArr
+}
+
+// Thin pool metadata
+type Pool struct {
+	UUID         string
+	Time         int64 // current pool time, it incremented on every snapshot
+	Transaction  int64
+	BlockSize    int64 // data block size, bytes
+	NrDataBlocks int64 // size of data device, blocks
+	Devices      []Device
+	Skipped      []int // dev_ids of devices, which skipped by parser
+}
+
+// Find device by id. NONE_DEV_ID mean empty device without blocks.
+func (this *Pool) Device(id int) (*Device, error) {
+	if id == NONE_DEV_ID {
+		return &Device{Id: NONE_DEV_ID}, nil
+	}
+	available := make([]int, len(this.Devices))
+	for i := range this.Devices {
+		if this.Devices[i].Id == id {
+			return &this.Devices[i], nil
+		}
+		available[i] = this.Devices[i].Id
+	}
+	if containsInt(this.Skipped, id) {
+		return nil, fmt.Errorf("Device with dev_id %v skipped by metadata parser", id)
+	}
+	available = append(available, this.Skipped...)
+	sort.Ints(available)
+	return nil, &DeviceNotFoundError{Id: id, Available: available}
 }
 
 // Operation
@@ -48,27 +91,31 @@ const (
 	NONE = iota
 	WRITE
 	DELETE
+	END  // end of patch stream, followed by patchTrailer
+	ZERO // origin range must contain zeros, record hasn't data. Since patch version 5.
 )
 
-type dataPatch struct {
+// Operation for patch origin range of from device to get to device
+type Patch struct {
 	Operation int
 	Offset    int64
 	Length    int64
 }
 
-type blockArr []dataBlock
+// Blocks of device
+type BlockArr []Block
 
-var _ sort.Interface = blockArr{}
+var _ sort.Interface = BlockArr{}
 
-func (arr blockArr) Len() int {
+func (arr BlockArr) Len() int {
 	return len(arr)
 }
 
-func (arr blockArr) Less(i, j int) bool {
-	return arr[i].DataOffset < arr[j].DataOffset
+func (arr BlockArr) Less(i, j int) bool {
+	return arr[i].OriginOffset < arr[j].OriginOffset
 }
 
-func (arr blockArr) Swap(i, j int) {
+func (arr BlockArr) Swap(i, j int) {
 	tmp := arr[i]
 	arr[i] = arr[j]
 	arr[j] = tmp
@@ -82,16 +129,52 @@ func (arr blockArr) Swap(i, j int) {
 ВАЖНО - From и To портятся в процессе работы.
 */
 type dataBlockArrCutter struct {
-	from, to blockArr // Рабочие массивы, отсортированы по Originffset. ВАЖНО - портятся в процессе работы.
+	from, to BlockArr // Рабочие массивы, отсортированы по Originffset. ВАЖНО - портятся в процессе работы.
+
+	// Если источники заданы - массивы пополняются из них по одному блоку, когда становятся пустыми.
+	fromSrc, toSrc BlockSource
+}
+
+/*
+Создает структуру, которая читает блоки из источников по мере надобности. В памяти находится не больше одного блока
+каждого источника.
+*/
+func newDataBlockSourceCutter(from, to BlockSource) dataBlockArrCutter {
+	return dataBlockArrCutter{fromSrc: from, toSrc: to}
+}
+
+// Пополняет пустые массивы из источников. Исчерпанный источник обнуляется.
+func (this *dataBlockArrCutter) fill() error {
+	var err error
+	this.from, this.fromSrc, err = fillFromSource(this.from, this.fromSrc)
+	if err != nil {
+		return err
+	}
+	this.to, this.toSrc, err = fillFromSource(this.to, this.toSrc)
+	return err
+}
+
+func fillFromSource(arr BlockArr, src BlockSource) (BlockArr, BlockSource, error) {
+	if len(arr) != 0 || src == nil {
+		return arr, src, nil
+	}
+	block, ok, err := src.Next()
+	if err != nil {
+		return arr, src, err
+	}
+	if !ok {
+		return arr, nil, nil
+	}
+	return append(arr[:0], block), src, nil
 }
 
 /*
 Создает структуру с КОПИЯМИ from и to, чтобы в процессе работы портились именно копии, а не основные массивы
 */
-func newDataBlockArrCutter(from, to blockArr) dataBlockArrCutter {
+func newDataBlockArrCutter(from, to BlockArr) dataBlockArrCutter {
 	var res dataBlockArrCutter
-	res.from = make(blockArr, len(from))
-	res.to = make(blockArr, len(to))
+	res.from = make(BlockArr, len(from))
+	res.to = make(BlockArr, len(to))
 	copy(res.from, from)
 	copy(res.to, to)
 	return res
@@ -107,7 +190,10 @@ func newDataBlockArrCutter(from, to blockArr) dataBlockArrCutter {
 Если from и to начинаются в разных местах, но перекрываются - возвращает кусок данных. Который начинается раньше и длиной до начала
         блока данных второго массива. Чтобы при следующем вызове вернуться в ситуацию, когда массивы начинаются по одному смешению.
 */
-func (this *dataBlockArrCutter) Cut() (ok bool, bFrom, bTo dataBlock) {
+func (this *dataBlockArrCutter) Cut() (ok bool, bFrom, bTo Block, err error) {
+	if err = this.fill(); err != nil {
+		return
+	}
 	switch {
 	case len(this.from) == 0 && len(this.to) == 0:
 		return // возвращаем пустые данные
@@ -193,9 +279,63 @@ func (this *dataBlockArrCutter) Cut() (ok bool, bFrom, bTo dataBlock) {
 			this.to = this.to[1:]
 			return
 		default:
-			panic(fmt.Errorf("Unhandled variant in cutHeader 2 %#v %#v:", *firstFrom, *firstTo))
+			err = fmt.Errorf("Unhandled variant in cutHeader 2 %#v %#v:", *firstFrom, *firstTo)
+			return
 		}
 	default:
-		panic(fmt.Errorf("Unhandled variant in cutHead: %#v %#v", *firstFrom, *firstTo))
+		err = fmt.Errorf("Unhandled variant in cutHead: %#v %#v", *firstFrom, *firstTo)
+		return
+	}
+}
+
+// Offset for next then last byte of origin data of all blocks
+func (arr BlockArr) OriginLast() (res int64) {
+	for i := range arr {
+		if last := arr[i].OriginLast(); last > res {
+			res = last
+		}
+	}
+	return res
+}
+
+/*
+Return sorted by origin offset copy of arr, which can be used by cutter: empty blocks removed, contiguous blocks
+merged. Return error if blocks overlap by origin offset.
+*/
+func (arr BlockArr) Normalize() (BlockArr, error) {
+	sorted := make(BlockArr, 0, len(arr))
+	for _, block := range arr {
+		if block.Length < 0 {
+			return nil, fmt.Errorf("Block with negative length: %#v", block)
+		}
+		if block.Length > 0 {
+			sorted = append(sorted, block)
+		}
+	}
+	sort.Stable(sorted)
+
+	res := make(BlockArr, 0, len(sorted))
+	for _, block := range sorted {
+		if len(res) > 0 && res[len(res)-1].OriginLast() > block.OriginOffset {
+			return nil, fmt.Errorf("Blocks overlap by origin offset: %#v and %#v", res[len(res)-1], block)
+		}
+		res = res.appendMerged(block)
+	}
+	return res, nil
+}
+
+// Append blocks to arr. Block, which contiguous with last block of arr in origin and data offsets and has same time,
+// merged with it.
+func (arr BlockArr) appendMerged(blocks ...Block) BlockArr {
+	for _, block := range blocks {
+		if len(arr) > 0 {
+			last := &arr[len(arr)-1]
+			if last.OriginLast() == block.OriginOffset && last.DataOffset+last.Length == block.DataOffset && last.Time == block.Time {
+				last.Length += block.Length
+				continue
+			}
+		}
+		arr = append(arr, block)
 	}
+	return arr
 }
@@ -1,14 +1,21 @@
 package lvm_thin_diff
 
-import "testing"
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
 
 func TestCutHead(t *testing.T){
 	var data dataBlockArrCutter
-	var bFrom, bTo, expectedBFrom, expectedBTo dataBlock
-	var expectedFromArr, expectedToArr blockArr
+	var bFrom, bTo, expectedBFrom, expectedBTo Block
+	var expectedFromArr, expectedToArr BlockArr
 	var ok, expectedOk bool
+	var err error
 
-	equals := func(a,b blockArr)bool{
+	equals := func(a,b BlockArr)bool{
 		if len(a) != len(b){
 			return false
 		}
@@ -22,6 +29,10 @@ func TestCutHead(t *testing.T){
 
 	isOk := func()(res bool){
 		res = true
+		if err != nil {
+			t.Errorf("err: %v", err)
+			res = false
+		}
 		if ok != expectedOk {
 			t.Errorf("ok: %#v != %#v", ok, expectedOk)
 			res = false
@@ -55,36 +66,36 @@ func TestCutHead(t *testing.T){
 	// FROM:
 	// TO:   DDDDDDDD
 	data = dataBlockArrCutter{
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedFromArr = blockArr{}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedFromArr = BlockArr{}
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
 
 	// EmptyTo
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedBTo = dataBlock{}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedBTo = Block{}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{}
-	ok, bFrom, bTo = data.Cut()
+	expectedToArr = BlockArr{}
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -92,25 +103,25 @@ func TestCutHead(t *testing.T){
 
 	// firstFrom empty
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:10,DataOffset:20,Length:0},
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:10,DataOffset:20,Length:0},
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:250,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:250,Length:300},
+			Block{OriginOffset:400,DataOffset:550,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:250,Length:300}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedBTo = Block{OriginOffset:100,DataOffset:250,Length:300}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:550,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -119,25 +130,25 @@ func TestCutHead(t *testing.T){
 	// FROM: DDDDDDDD
 	// TO:
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:10,DataOffset:20,Length:0},
-			dataBlock{OriginOffset:100,DataOffset:250,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:10,DataOffset:20,Length:0},
+			Block{OriginOffset:100,DataOffset:250,Length:300},
+			Block{OriginOffset:400,DataOffset:550,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:250,Length:300}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedBTo = Block{OriginOffset:100,DataOffset:250,Length:300}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:550,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -146,23 +157,23 @@ func TestCutHead(t *testing.T){
 	// FROM: DDDDDDDD
 	// TO:                 DDDDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:800,DataOffset:550,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:800,DataOffset:550,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedBTo = dataBlock{}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedBTo = Block{}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:800,DataOffset:550,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:800,DataOffset:550,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -171,23 +182,23 @@ func TestCutHead(t *testing.T){
 	// FROM: DDDDDDDD
 	// TO:           DDDDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:400,DataOffset:550,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedBTo = dataBlock{}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedBTo = Block{}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:550,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -196,23 +207,23 @@ func TestCutHead(t *testing.T){
 	// FROM:               DDDDDDDDDD
 	// TO:   DDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:800,DataOffset:550,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:800,DataOffset:550,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:800,DataOffset:550,Length:600},
+	expectedBFrom = Block{}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:800,DataOffset:550,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -221,23 +232,23 @@ func TestCutHead(t *testing.T){
 	// FROM:         DDDDDDDDDD
 	// TO:   DDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:400,DataOffset:550,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:300}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:550,Length:600},
+	expectedBFrom = Block{}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:300}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:550,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -247,24 +258,24 @@ func TestCutHead(t *testing.T){
 	// FROM: DDDDDDD
 	// TO:       DDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:250,DataOffset:550,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:250,DataOffset:550,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:150}
-	expectedBTo = dataBlock{}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:250,DataOffset:350,Length:150},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:150}
+	expectedBTo = Block{}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:250,DataOffset:350,Length:150},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:250,DataOffset:550,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:250,DataOffset:550,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -273,24 +284,24 @@ func TestCutHead(t *testing.T){
 	// FROM:     DDDDDDD
 	// TO:   DDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:250,DataOffset:550,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:250,DataOffset:550,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:150}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:250,DataOffset:550,Length:600},
+	expectedBFrom = Block{}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:150}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:250,DataOffset:550,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:250,DataOffset:350,Length:150},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:250,DataOffset:350,Length:150},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -299,25 +310,25 @@ func TestCutHead(t *testing.T){
 	// FROM:  DDDDD
 	// TO:    DDDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-			dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:550,Length:200},
+			Block{OriginOffset:300,DataOffset:550,Length:250},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:550,Length:200}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:200}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:550,Length:200}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:200}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:300,DataOffset:550,Length:250},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:300,DataOffset:400,Length:100},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:300,DataOffset:400,Length:100},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -326,25 +337,25 @@ func TestCutHead(t *testing.T){
 	// FROM:  DDDDD
 	// TO:    DDDDDDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-			dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:550,Length:200},
+			Block{OriginOffset:300,DataOffset:550,Length:250},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:200}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:550,Length:200}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:300,DataOffset:400,Length:100},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:200}
+	expectedBTo = Block{OriginOffset:100,DataOffset:550,Length:200}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:300,DataOffset:400,Length:100},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:300,DataOffset:550,Length:250},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -354,24 +365,24 @@ func TestCutHead(t *testing.T){
 	// FROM:  DDDDD
 	// TO:    DDDDD
 	data = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:200},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:200},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-			dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:550,Length:200},
+			Block{OriginOffset:300,DataOffset:550,Length:250},
 		},
 	}
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:200}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:550,Length:200}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:200}
+	expectedBTo = Block{OriginOffset:100,DataOffset:550,Length:200}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:300,DataOffset:550,Length:250},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -382,11 +393,12 @@ func TestNewDataBlockArrCutter(t *testing.T){
 	// broke original arrs
 
 	var data, dataOrig dataBlockArrCutter
-	var bFrom, bTo, expectedBFrom, expectedBTo dataBlock
-	var expectedFromArr, expectedToArr blockArr
+	var bFrom, bTo, expectedBFrom, expectedBTo Block
+	var expectedFromArr, expectedToArr BlockArr
 	var ok, expectedOk bool
+	var err error
 
-	equals := func(a,b blockArr)bool{
+	equals := func(a,b BlockArr)bool{
 		if len(a) != len(b){
 			return false
 		}
@@ -400,6 +412,10 @@ func TestNewDataBlockArrCutter(t *testing.T){
 
 	isOk := func()(res bool){
 		res = true
+		if err != nil {
+			t.Errorf("err: %v", err)
+			res = false
+		}
 		if ok != expectedOk {
 			t.Errorf("ok: %#v != %#v", ok, expectedOk)
 			res = false
@@ -433,27 +449,27 @@ func TestNewDataBlockArrCutter(t *testing.T){
 	// FROM:  DDDDD
 	// TO:    DDDDDDDDD
 	dataOrig = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-			dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:550,Length:200},
+			Block{OriginOffset:300,DataOffset:550,Length:250},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
 	}
 	data = newDataBlockArrCutter(dataOrig.from, dataOrig.to)
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:550,Length:200}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:200,Length:200}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-		dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:550,Length:200}
+	expectedBTo = Block{OriginOffset:100,DataOffset:200,Length:200}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:100,DataOffset:550,Length:200},
+		Block{OriginOffset:300,DataOffset:550,Length:250},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:100,DataOffset:200,Length:300},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 
 	if !isOk(){
 		t.Error()
@@ -463,27 +479,27 @@ func TestNewDataBlockArrCutter(t *testing.T){
 	// FROM:  DDDDD
 	// TO:    DDDDDDDDD
 	dataOrig = dataBlockArrCutter{
-		from:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-			dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+		from:BlockArr{
+			Block{OriginOffset:100,DataOffset:200,Length:300},
+			Block{OriginOffset:400,DataOffset:500,Length:600},
 		},
-		to:blockArr{
-			dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-			dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+		to:BlockArr{
+			Block{OriginOffset:100,DataOffset:550,Length:200},
+			Block{OriginOffset:300,DataOffset:550,Length:250},
 		},
 	}
 	data = newDataBlockArrCutter(dataOrig.from, dataOrig.to)
-	expectedBFrom = dataBlock{OriginOffset:100,DataOffset:200,Length:200}
-	expectedBTo = dataBlock{OriginOffset:100,DataOffset:550,Length:200}
-	expectedFromArr = blockArr{
-		dataBlock{OriginOffset:100,DataOffset:200,Length:300},
-		dataBlock{OriginOffset:400,DataOffset:500,Length:600},
+	expectedBFrom = Block{OriginOffset:100,DataOffset:200,Length:200}
+	expectedBTo = Block{OriginOffset:100,DataOffset:550,Length:200}
+	expectedFromArr = BlockArr{
+		Block{OriginOffset:100,DataOffset:200,Length:300},
+		Block{OriginOffset:400,DataOffset:500,Length:600},
 	}
-	expectedToArr = blockArr{
-		dataBlock{OriginOffset:100,DataOffset:550,Length:200},
-		dataBlock{OriginOffset:300,DataOffset:550,Length:250},
+	expectedToArr = BlockArr{
+		Block{OriginOffset:100,DataOffset:550,Length:200},
+		Block{OriginOffset:300,DataOffset:550,Length:250},
 	}
-	ok, bFrom, bTo = data.Cut()
+	ok, bFrom, bTo, err = data.Cut()
 	if !isOk(){
 		t.Error()
 	}
@@ -492,11 +508,11 @@ func TestNewDataBlockArrCutter(t *testing.T){
 }
 
 func TestSplit(t *testing.T){
-	b := dataBlock{DataOffset:100, OriginOffset:200, Length:50}
+	b := Block{DataOffset:100, OriginOffset:200, Length:50}
 
 	l,r := b.Split(0)
-	lOK := dataBlock{DataOffset:100, OriginOffset:200, Length:0}
-	rOK := dataBlock{DataOffset:100, OriginOffset:200, Length:50}
+	lOK := Block{DataOffset:100, OriginOffset:200, Length:0}
+	rOK := Block{DataOffset:100, OriginOffset:200, Length:50}
 	if l != lOK {
 		t.Errorf("%#v != %#v", l, lOK)
 	}
@@ -506,8 +522,8 @@ func TestSplit(t *testing.T){
 
 
 	l,r = b.Split(10)
-	lOK = dataBlock{DataOffset:100, OriginOffset:200, Length:10}
-	rOK = dataBlock{DataOffset:110, OriginOffset:210, Length:40}
+	lOK = Block{DataOffset:100, OriginOffset:200, Length:10}
+	rOK = Block{DataOffset:110, OriginOffset:210, Length:40}
 	if l != lOK {
 		t.Errorf("%#v != %#v", l, lOK)
 	}
@@ -516,8 +532,8 @@ func TestSplit(t *testing.T){
 	}
 
 	l,r = b.Split(50)
-	lOK = dataBlock{DataOffset:100, OriginOffset:200, Length:50}
-	rOK = dataBlock{DataOffset:150, OriginOffset:250, Length:0}
+	lOK = Block{DataOffset:100, OriginOffset:200, Length:50}
+	rOK = Block{DataOffset:150, OriginOffset:250, Length:0}
 	if l != lOK {
 		t.Errorf("%#v != %#v", l, lOK)
 	}
@@ -525,9 +541,16 @@ func TestSplit(t *testing.T){
 		t.Errorf("%#v != %#v", r, rOK)
 	}
 
+	b.Time = 3
+	l,r = b.Split(10)
+	if l.Time != 3 || r.Time != 3 {
+		t.Errorf("%#v %#v", l, r)
+	}
+	b.Time = 0
+
 	l,r = b.Split(100)
-	lOK = dataBlock{DataOffset:100, OriginOffset:200, Length:50}
-	rOK = dataBlock{DataOffset:150, OriginOffset:250, Length:0}
+	lOK = Block{DataOffset:100, OriginOffset:200, Length:50}
+	rOK = Block{DataOffset:150, OriginOffset:250, Length:0}
 	if l != lOK {
 		t.Errorf("%#v != %#v", l, lOK)
 	}
@@ -535,3 +558,208 @@ func TestSplit(t *testing.T){
 		t.Errorf("%#v != %#v", r, rOK)
 	}
 }
+
+func TestBlockArrOriginLast(t *testing.T){
+	if res := (BlockArr{}).OriginLast(); res != 0 {
+		t.Error(res)
+	}
+
+	arr := BlockArr{
+		Block{OriginOffset:400,DataOffset:500,Length:600},
+		Block{OriginOffset:100,DataOffset:200,Length:300},
+	}
+	if res := arr.OriginLast(); res != 1000 {
+		t.Error(res)
+	}
+}
+
+func TestPoolDevice(t *testing.T){
+	pool := Pool{Devices:[]Device{{Id:1}, {Id:3}}}
+	dev, err := pool.Device(3)
+	if err != nil || dev.Id != 3 {
+		t.Error(dev, err)
+	}
+	_, err = pool.Device(2)
+	if exitCode(err) != EXIT_DEVICE_NOT_FOUND {
+		t.Error(err)
+	}
+	if err.Error() != "Device with dev_id 2 not found in metadata, available dev_ids: 1, 3" {
+		t.Error(err)
+	}
+
+	dev, err = pool.Device(NONE_DEV_ID)
+	if err != nil || dev.Id != NONE_DEV_ID || len(dev.Blocks) != 0 {
+		t.Error(dev, err)
+	}
+}
+
+func TestBlockArrAppendMerged(t *testing.T){
+	arr := BlockArr{{OriginOffset:0, DataOffset:100, Length:10}}
+	arr = arr.appendMerged(
+		Block{OriginOffset:10, DataOffset:110, Length:10},
+		Block{OriginOffset:20, DataOffset:200, Length:10},
+		Block{OriginOffset:30, DataOffset:210, Length:10},
+		Block{OriginOffset:50, DataOffset:220, Length:10},
+		Block{OriginOffset:60, DataOffset:230, Length:10, Time:1},
+		Block{OriginOffset:70, DataOffset:240, Length:10, Time:1},
+	)
+	expected := BlockArr{
+		{OriginOffset:0, DataOffset:100, Length:20},
+		{OriginOffset:20, DataOffset:200, Length:20},
+		{OriginOffset:50, DataOffset:220, Length:10},
+		{OriginOffset:60, DataOffset:230, Length:20, Time:1},
+	}
+	if !reflect.DeepEqual(arr, expected) {
+		t.Errorf("%#v", arr)
+	}
+}
+
+func TestBlockArrSort(t *testing.T){
+	arr := BlockArr{
+		{OriginOffset:20, DataOffset:0, Length:10},
+		{OriginOffset:0, DataOffset:50, Length:10},
+		{OriginOffset:10, DataOffset:10, Length:10},
+	}
+	sort.Sort(arr)
+	expected := BlockArr{
+		{OriginOffset:0, DataOffset:50, Length:10},
+		{OriginOffset:10, DataOffset:10, Length:10},
+		{OriginOffset:20, DataOffset:0, Length:10},
+	}
+	if !reflect.DeepEqual(arr, expected) {
+		t.Errorf("%#v", arr)
+	}
+}
+
+func TestBlockArrNormalize(t *testing.T){
+	arr := BlockArr{
+		{OriginOffset:30, DataOffset:130, Length:10},
+		{OriginOffset:10, DataOffset:110, Length:10},
+		{OriginOffset:50, DataOffset:0, Length:0},
+		{OriginOffset:0, DataOffset:100, Length:10},
+		{OriginOffset:20, DataOffset:120, Length:10, Time:1},
+	}
+	orig := append(BlockArr{}, arr...)
+	res, err := arr.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BlockArr{
+		{OriginOffset:0, DataOffset:100, Length:20},
+		{OriginOffset:20, DataOffset:120, Length:10, Time:1},
+		{OriginOffset:30, DataOffset:130, Length:10},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+	if !reflect.DeepEqual(arr, orig) {
+		t.Errorf("Source array changed: %#v", arr)
+	}
+
+	if res, err = (BlockArr{}).Normalize(); err != nil || len(res) != 0 {
+		t.Error(res, err)
+	}
+	if _, err = (BlockArr{{OriginOffset:10, Length:10}, {OriginOffset:0, DataOffset:50, Length:11}}).Normalize(); err == nil {
+		t.Error()
+	}
+	if _, err = (BlockArr{{OriginOffset:10, Length:-1}}).Normalize(); err == nil {
+		t.Error()
+	}
+
+	iter := Diff(&Device{Blocks:BlockArr{{OriginOffset:0, Length:10}, {OriginOffset:5, Length:10}}}, nil)
+	if _, ok, err := iter.Next(context.Background()); ok || err == nil {
+		t.Error(ok, err)
+	}
+}
+
+// Random not overlapped blocks in unit size ranges, in random order
+func randomBlocks(rnd *rand.Rand) BlockArr {
+	var res BlockArr
+	var offset int64
+	for i := rnd.Intn(10); i > 0; i-- {
+		offset += rnd.Int63n(5)
+		block := Block{OriginOffset:offset, DataOffset:rnd.Int63n(100), Length:1 + rnd.Int63n(8), Time:rnd.Int63n(2)}
+		res = append(res, block)
+		offset = block.OriginLast()
+	}
+	rnd.Shuffle(len(res), res.Swap)
+	return res
+}
+
+// Cut all blocks of from and to and check, that every origin unit of both arrays returned exactly once, with same
+// data offset and time, and blocks of one cut are aligned.
+func checkCutPartition(t *testing.T, from, to BlockArr) {
+	type unit struct {
+		data, time int64
+	}
+	expand := func(arr BlockArr) map[int64]unit {
+		res := make(map[int64]unit)
+		for _, block := range arr {
+			for i := int64(0); i < block.Length; i++ {
+				res[block.OriginOffset+i] = unit{block.DataOffset + i, block.Time}
+			}
+		}
+		return res
+	}
+	add := func(units map[int64]unit, block Block) {
+		for i := int64(0); i < block.Length; i++ {
+			if _, ok := units[block.OriginOffset+i]; ok {
+				t.Fatalf("Unit %v returned twice: %#v %#v", block.OriginOffset+i, from, to)
+			}
+			units[block.OriginOffset+i] = unit{block.DataOffset + i, block.Time}
+		}
+	}
+
+	normFrom, err := from.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	normTo, err := to.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutter := newDataBlockArrCutter(normFrom, normTo)
+	cutFrom, cutTo := make(map[int64]unit), make(map[int64]unit)
+	var last int64
+	for {
+		ok, bFrom, bTo, err := cutter.Cut()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if bFrom.IsEmpty() && bTo.IsEmpty() {
+			t.Fatalf("Empty cut: %#v %#v", from, to)
+		}
+		if !bFrom.IsEmpty() && !bTo.IsEmpty() && (bFrom.OriginOffset != bTo.OriginOffset || bFrom.Length != bTo.Length) {
+			t.Fatalf("Unaligned cut %#v %#v: %#v %#v", bFrom, bTo, from, to)
+		}
+		for _, block := range []Block{bFrom, bTo} {
+			if !block.IsEmpty() && block.OriginOffset < last {
+				t.Fatalf("Cut isn't ordered by origin: %#v %#v", from, to)
+			}
+		}
+		last = maxInt64(bFrom.OriginOffset, bTo.OriginOffset)
+		add(cutFrom, bFrom)
+		add(cutTo, bTo)
+	}
+	if !reflect.DeepEqual(cutFrom, expand(from)) || !reflect.DeepEqual(cutTo, expand(to)) {
+		t.Fatalf("Cut doesn't cover blocks: %#v %#v", from, to)
+	}
+}
+
+func TestCutPartitionProperty(t *testing.T){
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		checkCutPartition(t, randomBlocks(rnd), randomBlocks(rnd))
+	}
+}
+
+func FuzzCutPartition(f *testing.F){
+	f.Add(int64(0), int64(1))
+	f.Add(int64(42), int64(7))
+	f.Fuzz(func(t *testing.T, fromSeed, toSeed int64){
+		checkCutPartition(t, randomBlocks(rand.New(rand.NewSource(fromSeed))), randomBlocks(rand.New(rand.NewSource(toSeed))))
+	})
+}
@@ -0,0 +1,110 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Codec compress data chunks of patch. Every chunk compressed separately, so patch can be readed as stream.
+type Codec interface {
+	Name() string // name of codec, stored in patch header
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte, maxLength int64) ([]byte, error) // fail if decoded data longer than maxLength
+}
+
+var codecs = map[string]Codec{}
+
+func init() {
+	RegisterCodec(&streamCodec{
+		name: "gzip",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	RegisterCodec(&streamCodec{
+		name: "zlib",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	})
+	RegisterCodec(&streamCodec{
+		name: "flate",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+}
+
+// Register codec for use by name in WriteOptions.Codec. Codec must be registered for read patches, compressed by it.
+func RegisterCodec(codec Codec) {
+	codecs[codec.Name()] = codec
+}
+
+// Return codec by name. Empty name mean no compression, nil codec.
+func getCodec(name string) (Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec: %q", name)
+	}
+	return codec, nil
+}
+
+// Codec from compress stream reader and writer
+type streamCodec struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (this *streamCodec) Name() string {
+	return this.name
+}
+
+func (this *streamCodec) Encode(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer, err := this.newWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *streamCodec) Decode(data []byte, maxLength int64) ([]byte, error) {
+	reader, err := this.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	res, err := io.ReadAll(io.LimitReader(reader, maxLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(res)) > maxLength {
+		return nil, fmt.Errorf("Decoded data longer than %v bytes", maxLength)
+	}
+	return res, nil
+}
@@ -0,0 +1,48 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("test data "), 1000)
+	for _, name := range []string{"gzip", "zlib", "flate"} {
+		codec, err := getCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.Name() != name {
+			t.Error(codec.Name())
+		}
+		encoded, err := codec.Encode(data)
+		if err != nil {
+			t.Error(name, err)
+		}
+		if len(encoded) >= len(data) {
+			t.Error(name, len(encoded))
+		}
+		decoded, err := codec.Decode(encoded, int64(len(data)))
+		if err != nil {
+			t.Error(name, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Error(name)
+		}
+		if _, err = codec.Decode(data, int64(len(data))); err == nil {
+			t.Error(name)
+		}
+
+		// Decompression bomb
+		if _, err = codec.Decode(encoded, int64(len(data))-1); err == nil {
+			t.Error(name)
+		}
+	}
+
+	if codec, err := getCodec(""); codec != nil || err != nil {
+		t.Error(codec, err)
+	}
+	if _, err := getCodec("test"); err == nil {
+		t.Error()
+	}
+}
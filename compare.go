@@ -0,0 +1,142 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+type contentIterator struct {
+	iter           Iterator
+	data           io.ReaderAt
+	unit           int64
+	fromBuf, toBuf []byte
+	queue          []Change // changes of last splitted WRITE, which not returned yet
+}
+
+/*
+Compare data of from and to blocks of WRITE changes by units of unit bytes and replace WRITE of equal units by NONE.
+Data read from data - pool data device. It reduce patch for rewrites of same data by cost of read both blocks.
+WRITE changes are splitted, use Coalesce after it. unit <= 0 mean BUF_SIZE.
+*/
+func CompareContent(iter Iterator, data io.ReaderAt, unit int64) Iterator {
+	if unit <= 0 {
+		unit = BUF_SIZE
+	}
+	bufSize := minInt64(unit, BUF_SIZE)
+	return &contentIterator{
+		iter:    iter,
+		data:    data,
+		unit:    unit,
+		fromBuf: make([]byte, bufSize),
+		toBuf:   make([]byte, bufSize),
+	}
+}
+
+func (this *contentIterator) Next(ctx context.Context) (change Change, ok bool, err error) {
+	if len(this.queue) == 0 {
+		change, ok, err = this.iter.Next(ctx)
+		if !ok || err != nil || change.Operation != WRITE || len(change.From) == 0 {
+			return change, ok, err
+		}
+		err = this.split(ctx, change)
+		if err != nil {
+			return change, false, err
+		}
+	}
+	change = this.queue[0]
+	this.queue = this.queue[1:]
+	return change, true, nil
+}
+
+// Split WRITE change to changes with equal and different data
+func (this *contentIterator) split(ctx context.Context, change Change) error {
+	cutter := newDataBlockArrCutter(change.From, change.To)
+	for {
+		ok, bFrom, bTo, err := cutter.Cut()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if bFrom.IsEmpty() || bTo.IsEmpty() {
+			// Data of one side only: nothing to compare
+			patch, err := calcDiff(bFrom, bTo)
+			if err != nil {
+				return err
+			}
+			this.queue = append(this.queue, newChange(patch, bFrom, bTo))
+			continue
+		}
+
+		for bTo.Length > 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			var unitFrom, unitTo Block
+			unitFrom, bFrom = bFrom.Split(this.unit)
+			unitTo, bTo = bTo.Split(this.unit)
+			equal, err := this.equalData(unitFrom.DataOffset, unitTo.DataOffset, unitTo.Length)
+			if err != nil {
+				return err
+			}
+			patch := Patch{Offset: unitTo.OriginOffset, Operation: WRITE, Length: unitTo.Length}
+			if equal {
+				patch = Patch{Operation: NONE}
+			}
+			this.appendUnit(patch, unitFrom, unitTo)
+		}
+	}
+}
+
+// Add unit to queue, merge it with previous change if it has same operation and contiguous blocks
+func (this *contentIterator) appendUnit(patch Patch, unitFrom, unitTo Block) {
+	if len(this.queue) > 0 {
+		last := &this.queue[len(this.queue)-1]
+		if last.Operation == patch.Operation && len(last.From) == 1 && len(last.To) == 1 {
+			lastFrom, lastTo := &last.From[0], &last.To[0]
+			if lastTo.OriginLast() == unitTo.OriginOffset &&
+				lastFrom.DataOffset+lastFrom.Length == unitFrom.DataOffset &&
+				lastTo.DataOffset+lastTo.Length == unitTo.DataOffset {
+				lastFrom.Length += unitFrom.Length
+				lastTo.Length += unitTo.Length
+				if last.Operation == WRITE {
+					last.Length += unitTo.Length
+				}
+				return
+			}
+		}
+	}
+	this.queue = append(this.queue, newChange(patch, unitFrom, unitTo))
+}
+
+// Compare length bytes of data device at two offsets
+func (this *contentIterator) equalData(fromOffset, toOffset, length int64) (bool, error) {
+	for readed := int64(0); readed < length; {
+		size := minInt64(int64(len(this.fromBuf)), length-readed)
+		fromBuf, toBuf := this.fromBuf[:size], this.toBuf[:size]
+		if _, err := this.data.ReadAt(fromBuf, fromOffset+readed); err != nil {
+			return false, &DataReadError{Err: err}
+		}
+		if _, err := this.data.ReadAt(toBuf, toOffset+readed); err != nil {
+			return false, &DataReadError{Err: err}
+		}
+		if !bytes.Equal(fromBuf, toBuf) {
+			return false, nil
+		}
+		readed += size
+	}
+	return true, nil
+}
+
+func newChange(patch Patch, bFrom, bTo Block) Change {
+	change := Change{Patch: patch}
+	if !bFrom.IsEmpty() {
+		change.From = BlockArr{bFrom}
+	}
+	if !bTo.IsEmpty() {
+		change.To = BlockArr{bTo}
+	}
+	return change
+}
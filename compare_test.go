@@ -0,0 +1,79 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCompareContent(t *testing.T) {
+	data := []byte("aaaabbbbcccc--------aaaaXXXXcccc----dddd")
+	from := &Device{Id: 1, Blocks: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 12}}}
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 20, Length: 12},
+		{OriginOffset: 12, DataOffset: 36, Length: 4},
+	}}
+	res := readAllChanges(t, Coalesce(CompareContent(Diff(from, to), bytes.NewReader(data), 4)))
+	expected := []Change{
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 4}}, To: BlockArr{{OriginOffset: 0, DataOffset: 20, Length: 4}}},
+		{Patch: Patch{Operation: WRITE, Offset: 4, Length: 4}, From: BlockArr{{OriginOffset: 4, DataOffset: 4, Length: 4}}, To: BlockArr{{OriginOffset: 4, DataOffset: 24, Length: 4}}},
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 8, DataOffset: 8, Length: 4}}, To: BlockArr{{OriginOffset: 8, DataOffset: 28, Length: 4}}},
+		{Patch: Patch{Operation: WRITE, Offset: 12, Length: 4}, To: BlockArr{{OriginOffset: 12, DataOffset: 36, Length: 4}}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+
+	// Equal units are merged
+	to.Blocks = BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 4}, {OriginOffset: 4, DataOffset: 4, Length: 8, Time: 1}}
+	from.Blocks = BlockArr{{OriginOffset: 0, DataOffset: 20, Length: 4}, {OriginOffset: 4, DataOffset: 0, Length: 8}}
+	res = readAllChanges(t, CompareContent(Diff(from, to), bytes.NewReader(data), 2))
+	expected = []Change{
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 0, DataOffset: 20, Length: 4}}, To: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 4}}},
+		{Patch: Patch{Operation: WRITE, Offset: 4, Length: 8}, From: BlockArr{{OriginOffset: 4, DataOffset: 0, Length: 8}}, To: BlockArr{{OriginOffset: 4, DataOffset: 4, Length: 8, Time: 1}}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+
+	// Read error
+	iter := CompareContent(Diff(from, to), bytes.NewReader(data[:10]), 4)
+	if _, _, err := iter.Next(context.Background()); exitCode(err) != EXIT_DATA_READ {
+		t.Error(err)
+	}
+}
+
+func TestWritePatchCompareContent(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data[:500] {
+		data[i] = byte(i)
+	}
+	copy(data[500:], data[:100]) // rewrite of same data
+	data[560] = 255
+	from := &Device{Id: 1, Blocks: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 100}}}
+	to := &Device{Id: 2, Blocks: BlockArr{{OriginOffset: 0, DataOffset: 500, Length: 100}}}
+	const size = 100
+
+	opts := WriteOptions{BlockSize: 20, FromDevId: 1, ToDevId: 2, Size: size}
+	full, compared := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := WritePatch(context.Background(), full, bytes.NewReader(data), Coalesce(Diff(from, to)), opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.CompareContent = true
+	if err := WritePatch(context.Background(), compared, bytes.NewReader(data), Coalesce(Diff(from, to)), opts); err != nil {
+		t.Fatal(err)
+	}
+	if compared.Len() >= full.Len()-60 {
+		t.Error(compared.Len(), full.Len())
+	}
+
+	target := memWriterAt(deviceImage(data, from, size))
+	err := ApplyPatch(context.Background(), compared, target, ApplyOptions{FromDevId: 1, TargetSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(target, deviceImage(data, to, size)) {
+		t.Error()
+	}
+}
@@ -0,0 +1,232 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+)
+
+const (
+	ENCRYPTION_AES_GCM = "aes-256-gcm"
+
+	// 12 bytes GCM nonce: 4 random bytes of patch (header NoncePrefix) and 8 bytes big endian number of chunk.
+	// Nonces are unique inside patch only, since version 7 every patch has own subkey.
+	nonceSchemePrefixCounter = "prefix32-counter64"
+
+	// HKDF-SHA256 info for per-patch subkeys of data chunks and MAC of records
+	subkeyInfoData = "lvm-thin-diff data key"
+	subkeyInfoMAC  = "lvm-thin-diff mac key"
+
+	keySize        = 32
+	kdfIterations  = 600000 // PBKDF2-SHA256
+	kdfSaltSize    = 16
+	subkeySaltSize = 32
+	noncePrefixLen = 4
+)
+
+// Key for encryption of patch data. It is raw key or passphrase, which converted to key by PBKDF2 with salt from
+// patch header. Data is encrypted by subkey of patch, derived from the key by HKDF with random salt from patch header.
+type Key struct {
+	raw        []byte
+	passphrase string
+}
+
+// Key from raw 32 bytes
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != keySize {
+		return nil, fmt.Errorf("Key must be %v bytes, got %v", keySize, len(raw))
+	}
+	return &Key{raw: raw}, nil
+}
+
+func NewPassphraseKey(passphrase string) (*Key, error) {
+	if passphrase == "" {
+		return nil, errors.New("Empty passphrase")
+	}
+	return &Key{passphrase: passphrase}, nil
+}
+
+// Read key file with 32 bytes of raw key or 64 hex digits.
+func LoadKeyFile(path string) (*Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) != keySize {
+		decoded, err := hex.DecodeString(string(bytes.TrimSpace(content)))
+		if err == nil {
+			content = decoded
+		}
+	}
+	return NewKey(content)
+}
+
+// Read passphrase from first line of file.
+func LoadPassphraseFile(path string) (*Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if pos := bytes.IndexByte(content, '\n'); pos >= 0 {
+		content = content[:pos]
+	}
+	return NewPassphraseKey(string(bytes.TrimSuffix(content, []byte("\r"))))
+}
+
+// Fill encryption fields of header and return cipher for data chunks.
+func (this *Key) newHeaderCipher(header *patchHeader) (*chunkCipher, error) {
+	header.Encryption = ENCRYPTION_AES_GCM
+	header.NonceScheme = nonceSchemePrefixCounter
+	header.NoncePrefix = make([]byte, noncePrefixLen)
+	_, err := rand.Read(header.NoncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if this.passphrase != "" {
+		header.KdfSalt = make([]byte, kdfSaltSize)
+		_, err = rand.Read(header.KdfSalt)
+		if err != nil {
+			return nil, err
+		}
+		header.KdfIterations = kdfIterations
+	}
+	header.SubkeySalt = make([]byte, subkeySaltSize)
+	_, err = rand.Read(header.SubkeySalt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := this.derive(header)
+	if err != nil {
+		return nil, err
+	}
+	header.KeyId = keyId(key)
+	return newHeaderChunkCipher(key, header)
+}
+
+// Return cipher for data chunks of patch with header.
+func (this *Key) headerCipher(header *patchHeader) (*chunkCipher, error) {
+	if header.Encryption != ENCRYPTION_AES_GCM {
+		return nil, fmt.Errorf("Unsupported encryption: %q", header.Encryption)
+	}
+	if header.NonceScheme != nonceSchemePrefixCounter || len(header.NoncePrefix) != noncePrefixLen {
+		return nil, fmt.Errorf("Unsupported nonce scheme: %q", header.NonceScheme)
+	}
+	if header.Version < 7 {
+		return nil, errors.New("Encrypted patch before version 7 hasn't authentication of records, it isn't supported")
+	}
+	if (this.passphrase != "") != (header.KdfIterations > 0) {
+		return nil, errors.New("Patch and key use different key types: passphrase and raw key")
+	}
+	key, err := this.derive(header)
+	if err != nil {
+		return nil, err
+	}
+	if id := keyId(key); id != header.KeyId {
+		return nil, fmt.Errorf("Wrong key: key id %v, but patch encrypted by key %v", id, header.KeyId)
+	}
+	return newHeaderChunkCipher(key, header)
+}
+
+// Cipher by subkeys of patch
+func newHeaderChunkCipher(key []byte, header *patchHeader) (*chunkCipher, error) {
+	dataKey, err := hkdf.Key(sha256.New, key, header.SubkeySalt, subkeyInfoData, keySize)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newChunkCipher(dataKey, header.NoncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	res.macKey, err = hkdf.Key(sha256.New, key, header.SubkeySalt, subkeyInfoMAC, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (this *Key) derive(header *patchHeader) ([]byte, error) {
+	if this.passphrase == "" {
+		return this.raw, nil
+	}
+	return pbkdf2.Key(sha256.New, this.passphrase, header.KdfSalt, header.KdfIterations, keySize)
+}
+
+// Id of key for detect wrong key before decrypt: first 8 bytes of sha256 of key, hex.
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// AES-GCM encryption of chunks. Every chunk has own nonce by its number and bound to its origin offset, so chunks
+// can't be reordered or moved to other place. Records and trailer of encrypted patch are authenticated by HMAC.
+type chunkCipher struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint64
+	macKey      []byte // HMAC-SHA256 key of records and trailer
+}
+
+func newChunkCipher(key, noncePrefix []byte) (*chunkCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead, noncePrefix: noncePrefix}, nil
+}
+
+func (this *chunkCipher) nextNonce() []byte {
+	nonce := this.nonce(this.counter)
+	this.counter++
+	return nonce
+}
+
+func (this *chunkCipher) nonce(counter uint64) []byte {
+	nonce := make([]byte, this.aead.NonceSize())
+	copy(nonce, this.noncePrefix)
+	binary.BigEndian.PutUint64(nonce[len(this.noncePrefix):], counter)
+	return nonce
+}
+
+func offsetData(offset int64) []byte {
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, uint64(offset))
+	return res
+}
+
+func (this *chunkCipher) Seal(offset int64, data []byte) []byte {
+	return this.aead.Seal(nil, this.nextNonce(), data, offsetData(offset))
+}
+
+func (this *chunkCipher) Open(offset int64, data []byte) ([]byte, error) {
+	return this.aead.Open(nil, this.nextNonce(), data, offsetData(offset))
+}
+
+// Seal chunk with number chunk as nonce counter, for random access to chunks. Doesn't change counter.
+func (this *chunkCipher) SealChunk(chunk uint64, offset int64, data []byte) []byte {
+	return this.aead.Seal(nil, this.nonce(chunk), data, offsetData(offset))
+}
+
+// Open chunk, sealed by SealChunk. Can be called concurrently.
+func (this *chunkCipher) OpenChunk(chunk uint64, offset int64, data []byte) ([]byte, error) {
+	return this.aead.Open(nil, this.nonce(chunk), data, offsetData(offset))
+}
+
+// HMAC-SHA256 by MAC subkey of patch
+func (this *chunkCipher) newMAC() hash.Hash {
+	return hmac.New(sha256.New, this.macKey)
+}
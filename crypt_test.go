@@ -0,0 +1,224 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{0xab}, keySize)
+
+	path := filepath.Join(dir, "raw")
+	os.WriteFile(path, raw, 0600)
+	key, err := LoadKeyFile(path)
+	if err != nil || !bytes.Equal(key.raw, raw) {
+		t.Error(key, err)
+	}
+
+	path = filepath.Join(dir, "hex")
+	os.WriteFile(path, bytes.Repeat([]byte("ab"), keySize), 0600)
+	key, err = LoadKeyFile(path)
+	if err != nil || !bytes.Equal(key.raw, raw) {
+		t.Error(key, err)
+	}
+
+	path = filepath.Join(dir, "short")
+	os.WriteFile(path, []byte("ab"), 0600)
+	if _, err = LoadKeyFile(path); err == nil {
+		t.Error()
+	}
+
+	path = filepath.Join(dir, "passphrase")
+	os.WriteFile(path, []byte("secret phrase\nsecond line"), 0600)
+	key, err = LoadPassphraseFile(path)
+	if err != nil || key.passphrase != "secret phrase" {
+		t.Error(key, err)
+	}
+
+	path = filepath.Join(dir, "empty")
+	os.WriteFile(path, []byte("\n"), 0600)
+	if _, err = LoadPassphraseFile(path); err == nil {
+		t.Error()
+	}
+}
+
+func TestChunkCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, keySize)
+	prefix := []byte{1, 2, 3, 4}
+	writer, _ := newChunkCipher(key, prefix)
+	encrypted1 := writer.Seal(100, []byte("test1"))
+	encrypted2 := writer.Seal(200, []byte("test2"))
+
+	reader, _ := newChunkCipher(key, prefix)
+	data, err := reader.Open(100, encrypted1)
+	if err != nil || string(data) != "test1" {
+		t.Error(string(data), err)
+	}
+	data, err = reader.Open(200, encrypted2)
+	if err != nil || string(data) != "test2" {
+		t.Error(string(data), err)
+	}
+
+	// Other offset
+	reader, _ = newChunkCipher(key, prefix)
+	if _, err = reader.Open(101, encrypted1); err == nil {
+		t.Error()
+	}
+
+	// Other order
+	reader, _ = newChunkCipher(key, prefix)
+	if _, err = reader.Open(200, encrypted2); err == nil {
+		t.Error()
+	}
+
+	// Tampered
+	reader, _ = newChunkCipher(key, prefix)
+	encrypted1[0] ^= 1
+	if _, err = reader.Open(100, encrypted1); err == nil {
+		t.Error()
+	}
+}
+
+func TestEncryptedPatch(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 100},
+		{OriginOffset: 200, DataOffset: 500, Length: 300},
+	}}
+	const size = 500
+	rawKey, _ := NewKey(bytes.Repeat([]byte{1}, keySize))
+	otherKey, _ := NewKey(bytes.Repeat([]byte{2}, keySize))
+	passphraseKey, _ := NewPassphraseKey("secret")
+	otherPassphraseKey, _ := NewPassphraseKey("other")
+
+	for _, key := range []*Key{rawKey, passphraseKey} {
+		buf := &bytes.Buffer{}
+		opts := WriteOptions{FromDevId: NONE_DEV_ID, ToDevId: 2, Size: size, BufSize: 64, Codec: "gzip", Key: key}
+		err := WritePatch(context.Background(), buf, bytes.NewReader(data), Diff(nil, to), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch := buf.Bytes()
+		if bytes.Contains(patch, []byte("0123456789")) {
+			t.Error("Not encrypted data")
+		}
+
+		target := make(memWriterAt, size)
+		err = ApplyPatch(context.Background(), bytes.NewReader(patch), target, ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: size, Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(target, deviceImage(data, to, size)) {
+			t.Error()
+		}
+
+		// No key
+		err = ApplyPatch(context.Background(), bytes.NewReader(patch), make(memWriterAt, size), ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: size})
+		if exitCode(err) != EXIT_PATCH {
+			t.Error(err)
+		}
+
+		// Wrong key
+		for _, wrongKey := range []*Key{otherKey, otherPassphraseKey} {
+			err = ApplyPatch(context.Background(), bytes.NewReader(patch), make(memWriterAt, size), ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: size, Key: wrongKey})
+			if exitCode(err) != EXIT_PATCH {
+				t.Error(err)
+			}
+		}
+
+		if err = VerifyPatch(context.Background(), bytes.NewReader(patch), VerifyOptions{}); err != nil {
+			t.Error(err)
+		}
+		if err = VerifyPatch(context.Background(), bytes.NewReader(patch), VerifyOptions{Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestHeaderCipherSubkey(t *testing.T) {
+	key, _ := NewKey(bytes.Repeat([]byte{1}, keySize))
+	var headers [2]patchHeader
+	var encrypted [2][]byte
+	for i := range headers {
+		headers[i] = newPatchHeader(1, 1, 2, 100)
+		_, err := key.newHeaderCipher(&headers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(headers[i].SubkeySalt) != subkeySaltSize {
+			t.Error(headers[i].SubkeySalt)
+		}
+
+		// Same nonce prefix in two patches doesn't reuse nonce with same key
+		headers[i].NoncePrefix = []byte{1, 2, 3, 4}
+		c, _ := newHeaderChunkCipher(key.raw, &headers[i])
+		encrypted[i] = c.Seal(0, []byte("test"))
+	}
+	if headers[0].KeyId != headers[1].KeyId || bytes.Equal(encrypted[0], encrypted[1]) {
+		t.Error()
+	}
+
+	c, err := key.headerCipher(&headers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Open(0, encrypted[0]); err != nil || string(data) != "test" {
+		t.Error(string(data), err)
+	}
+}
+
+func TestEncryptedPatchForgery(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	to := &Device{Id: 2, Blocks: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 100}}}
+	key, _ := NewKey(bytes.Repeat([]byte{1}, keySize))
+	buf := &bytes.Buffer{}
+	err := WritePatch(context.Background(), buf, bytes.NewReader(data), Diff(nil, to), WriteOptions{FromDevId: NONE_DEV_ID, ToDevId: 2, Size: 100, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newPatchReader(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := r.Header
+
+	// Records with valid checksums and trailer sum, but without key. Old version hasn't record checks.
+	oldHeader := header
+	oldHeader.Version = 6
+	for _, forgedHeader := range []patchHeader{header, oldHeader} {
+		buf.Reset()
+		w, _ := newPatchWriter(buf, forgedHeader, nil)
+		w.WritePatch(Patch{Operation: ZERO, Offset: 0, Length: 100})
+		w.Close()
+		zeroRange := func(offset, length int64) error {
+			t.Error("Forged record applied", offset, length)
+			return nil
+		}
+		err = ApplyPatch(context.Background(), bytes.NewReader(buf.Bytes()), make(memWriterAt, 100), ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: 100, ZeroRange: zeroRange, Key: key})
+		if exitCode(err) != EXIT_PATCH {
+			t.Error(forgedHeader.Version, err)
+		}
+		// Records aren't checked without key
+		err = ApplyPatch(context.Background(), bytes.NewReader(buf.Bytes()), make(memWriterAt, 100), ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: 100, ZeroRange: zeroRange})
+		if exitCode(err) != EXIT_PATCH {
+			t.Error(forgedHeader.Version, err)
+		}
+	}
+
+	// Valid records, trailer without MAC
+	buf.Reset()
+	w, _ := newPatchWriter(buf, header, nil)
+	w.cipher, _ = key.headerCipher(&header)
+	w.writeRecord(Patch{Operation: END})
+	w.enc.Encode(w.summary)
+	var trailer patchTrailer
+	copy(trailer.Sum[:], w.hash.Sum(nil))
+	w.enc.Encode(trailer)
+	if err = VerifyPatch(context.Background(), bytes.NewReader(buf.Bytes()), VerifyOptions{Key: key}); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,181 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"fmt"
+)
+
+// Change is operation of diff with blocks of from and to devices, which placed in origin range of the operation.
+// Data for WRITE operation placed in To blocks.
+type Change struct {
+	Patch
+	From, To BlockArr
+}
+
+// Iterator over changes, ordered by origin offset.
+type Iterator interface {
+	// Return next change. ok is false when changes are over.
+	Next(ctx context.Context) (change Change, ok bool, err error)
+}
+
+type diffIterator struct {
+	cutter dataBlockArrCutter
+	err    error // error of prepare blocks, returned by Next
+}
+
+// Diff of devices: changes for get to device from from device.
+// nil device mean empty device. Blocks of devices may be unsorted, but mustn't overlap.
+func Diff(from, to *Device) Iterator {
+	if from == nil {
+		from = &Device{Id: NONE_DEV_ID}
+	}
+	if to == nil {
+		to = &Device{Id: NONE_DEV_ID}
+	}
+	var res diffIterator
+	res.cutter.from, res.err = from.Blocks.Normalize()
+	if res.err != nil {
+		res.err = fmt.Errorf("Bad blocks of device %v: %v", from.Id, res.err)
+		return &res
+	}
+	res.cutter.to, res.err = to.Blocks.Normalize()
+	if res.err != nil {
+		res.err = fmt.Errorf("Bad blocks of device %v: %v", to.Id, res.err)
+	}
+	return &res
+}
+
+// Diff of devices, which blocks are readed from sources while iterate. nil source mean empty device.
+// Memory usage doesn't depend on count of blocks.
+func DiffSources(from, to BlockSource) Iterator {
+	return &diffIterator{cutter: newDataBlockSourceCutter(from, to)}
+}
+
+func (this *diffIterator) Next(ctx context.Context) (change Change, ok bool, err error) {
+	if this.err != nil {
+		return change, false, this.err
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	ok, bFrom, bTo, err := this.cutter.Cut()
+	if !ok || err != nil {
+		return
+	}
+	patch, err := calcDiff(bFrom, bTo)
+	if err != nil {
+		return
+	}
+	return newChange(patch, bFrom, bTo), true, nil
+}
+
+/*
+Создать команду для патча данных from так чтобы получились данные to.
+bFrom и bTo - два блока данных. Если оба блока не пустые - то они должны начинаться с одного логического смещения и
+быть равной длины.
+
+Пустой блок означает что в месте, указанном вторым блоком данных нет.
+*/
+func calcDiff(bFrom, bTo Block) (Patch, error) {
+	if bFrom.IsEmpty() && bTo.IsEmpty() {
+		return Patch{Operation: NONE}, nil
+	}
+
+	if bFrom.IsEmpty() {
+		return Patch{Offset: bTo.OriginOffset, Operation: WRITE, Length: bTo.Length}, nil
+	}
+
+	if bTo.IsEmpty() {
+		return Patch{Offset: bFrom.OriginOffset, Operation: DELETE, Length: bFrom.Length}, nil
+	}
+
+	if bFrom.OriginOffset != bTo.OriginOffset || bFrom.Length != bTo.Length {
+		return Patch{}, fmt.Errorf("bFrom and bTo must have same start and length: %#v %#v", bFrom, bTo)
+	}
+
+	if bFrom.DataOffset == bTo.DataOffset {
+		return Patch{Operation: NONE}, nil // Data is equal. Do nothing.
+	}
+
+	return Patch{Offset: bTo.OriginOffset, Operation: WRITE, Length: bTo.Length}, nil
+}
+
+type sinceIterator struct {
+	to    BlockSource
+	since int64
+}
+
+/*
+Changes of to device, which written at pool time since or later: WRITE for every such block. Pool time increments
+on every snapshot, so with since equal to snap_time of base snapshot it is diff from the snapshot, which doesn't need
+the snapshot in metadata. Discarded blocks are unknown by times, so the diff hasn't DELETE changes.
+*/
+func DiffSince(to BlockSource, since int64) Iterator {
+	return &sinceIterator{to: to, since: since}
+}
+
+func (this *sinceIterator) Next(ctx context.Context) (change Change, ok bool, err error) {
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		block, ok, err := this.to.Next()
+		if !ok || err != nil {
+			return change, false, err
+		}
+		if block.Time < this.since || block.Length == 0 {
+			continue
+		}
+		change.Patch = Patch{Offset: block.OriginOffset, Operation: WRITE, Length: block.Length}
+		change.To = BlockArr{block}
+		return change, true, nil
+	}
+}
+
+// Max blocks of merged change: memory of Coalesce doesn't depend of count of contiguous changes
+const coalesceMaxBlocks = 1024
+
+type coalesceIterator struct {
+	iter Iterator
+	next *Change // change, which readed from iter but not returned yet
+}
+
+// Merge contiguous by origin offset WRITE and DELETE changes into one change, up to coalesceMaxBlocks blocks.
+// Blocks of merged change, which contiguous in data device too, merged into one block - for read them in one
+// sequential request.
+func Coalesce(iter Iterator) Iterator {
+	return &coalesceIterator{iter: iter}
+}
+
+func (this *coalesceIterator) Next(ctx context.Context) (change Change, ok bool, err error) {
+	if this.next != nil {
+		change = *this.next
+		this.next = nil
+	} else {
+		change, ok, err = this.iter.Next(ctx)
+		if !ok || err != nil {
+			return
+		}
+	}
+	if change.Operation != WRITE && change.Operation != DELETE {
+		return change, true, nil
+	}
+
+	for {
+		next, ok, err := this.iter.Next(ctx)
+		if err != nil {
+			return change, false, err
+		}
+		if !ok {
+			return change, true, nil
+		}
+		if next.Operation != change.Operation || change.Offset+change.Length != next.Offset ||
+			len(change.From)+len(change.To) >= coalesceMaxBlocks {
+			this.next = &next
+			return change, true, nil
+		}
+		change.Length += next.Length
+		change.From = change.From.appendMerged(next.From...)
+		change.To = change.To.appendMerged(next.To...)
+	}
+}
@@ -0,0 +1,192 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCalcDiff(t *testing.T) {
+	var diff, expectedDiff Patch
+
+	diff, _ = calcDiff(Block{}, Block{})
+	if diff != expectedDiff {
+		t.Errorf("%#v", diff)
+	}
+
+	expectedDiff = Patch{Offset: 100, Length: 50, Operation: DELETE}
+	diff, _ = calcDiff(Block{OriginOffset: 100, DataOffset: 200, Length: 50}, Block{})
+	if diff != expectedDiff {
+		t.Errorf("%#v", diff)
+	}
+
+	expectedDiff = Patch{Offset: 100, Length: 50, Operation: WRITE}
+	diff, _ = calcDiff(Block{}, Block{OriginOffset: 100, DataOffset: 200, Length: 50})
+	if diff != expectedDiff {
+		t.Errorf("%#v", diff)
+	}
+
+	expectedDiff = Patch{Operation: NONE}
+	diff, _ = calcDiff(Block{OriginOffset: 100, DataOffset: 200, Length: 50}, Block{OriginOffset: 100, DataOffset: 200, Length: 50})
+	if diff != expectedDiff {
+		t.Errorf("%#v", diff)
+	}
+
+	expectedDiff = Patch{Operation: WRITE, Offset: 100, Length: 50}
+	diff, _ = calcDiff(Block{OriginOffset: 100, DataOffset: 500, Length: 50}, Block{OriginOffset: 100, DataOffset: 200, Length: 50})
+	if diff != expectedDiff {
+		t.Errorf("%#v", diff)
+	}
+
+	_, err := calcDiff(Block{OriginOffset: 100, DataOffset: 500, Length: 50}, Block{OriginOffset: 100, DataOffset: 200, Length: 40})
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := &Device{Id: 1, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 10},
+		{OriginOffset: 20, DataOffset: 100, Length: 10},
+	}}
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 5},
+		{OriginOffset: 5, DataOffset: 200, Length: 10},
+	}}
+	expected := []Change{
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 5}}, To: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 5}}},
+		{Patch: Patch{Operation: WRITE, Offset: 5, Length: 5}, From: BlockArr{{OriginOffset: 5, DataOffset: 5, Length: 5}}, To: BlockArr{{OriginOffset: 5, DataOffset: 200, Length: 5}}},
+		{Patch: Patch{Operation: WRITE, Offset: 10, Length: 5}, To: BlockArr{{OriginOffset: 10, DataOffset: 205, Length: 5}}},
+		{Patch: Patch{Operation: DELETE, Offset: 20, Length: 10}, From: BlockArr{{OriginOffset: 20, DataOffset: 100, Length: 10}}},
+	}
+
+	iter := Diff(from, to)
+	for i := 0; ; i++ {
+		change, ok, err := iter.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			if i != len(expected) {
+				t.Error(i)
+			}
+			break
+		}
+		if i >= len(expected) || !reflect.DeepEqual(change, expected[i]) {
+			t.Errorf("%v: %#v", i, change)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := Diff(from, to).Next(ctx); err == nil {
+		t.Error()
+	}
+}
+
+// Iterator over prepared changes
+type sliceIterator []Change
+
+func (this *sliceIterator) Next(ctx context.Context) (change Change, ok bool, err error) {
+	if len(*this) == 0 {
+		return change, false, nil
+	}
+	change = (*this)[0]
+	*this = (*this)[1:]
+	return change, true, nil
+}
+
+func readAllChanges(t *testing.T, iter Iterator) (res []Change) {
+	for {
+		change, ok, err := iter.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return res
+		}
+		res = append(res, change)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	iter := sliceIterator{
+		{Patch: Patch{Operation: WRITE, Offset: 0, Length: 10}, To: BlockArr{{OriginOffset: 0, DataOffset: 100, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 10, Length: 10}, From: BlockArr{{OriginOffset: 10, DataOffset: 10, Length: 10}}, To: BlockArr{{OriginOffset: 10, DataOffset: 110, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 20, Length: 10}, To: BlockArr{{OriginOffset: 20, DataOffset: 300, Length: 10}}},
+		{Patch: Patch{Operation: DELETE, Offset: 30, Length: 10}, From: BlockArr{{OriginOffset: 30, DataOffset: 30, Length: 10}}},
+		{Patch: Patch{Operation: DELETE, Offset: 40, Length: 10}, From: BlockArr{{OriginOffset: 40, DataOffset: 40, Length: 10}}},
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 50, DataOffset: 50, Length: 10}}, To: BlockArr{{OriginOffset: 50, DataOffset: 50, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 70, Length: 10}, To: BlockArr{{OriginOffset: 70, DataOffset: 400, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 90, Length: 10}, To: BlockArr{{OriginOffset: 90, DataOffset: 410, Length: 10}}},
+	}
+	expected := []Change{
+		{Patch: Patch{Operation: WRITE, Offset: 0, Length: 30}, From: BlockArr{{OriginOffset: 10, DataOffset: 10, Length: 10}}, To: BlockArr{{OriginOffset: 0, DataOffset: 100, Length: 20}, {OriginOffset: 20, DataOffset: 300, Length: 10}}},
+		{Patch: Patch{Operation: DELETE, Offset: 30, Length: 20}, From: BlockArr{{OriginOffset: 30, DataOffset: 30, Length: 20}}},
+		{Patch: Patch{Operation: NONE}, From: BlockArr{{OriginOffset: 50, DataOffset: 50, Length: 10}}, To: BlockArr{{OriginOffset: 50, DataOffset: 50, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 70, Length: 10}, To: BlockArr{{OriginOffset: 70, DataOffset: 400, Length: 10}}},
+		{Patch: Patch{Operation: WRITE, Offset: 90, Length: 10}, To: BlockArr{{OriginOffset: 90, DataOffset: 410, Length: 10}}},
+	}
+	res := readAllChanges(t, Coalesce(&iter))
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+}
+
+// Source of n contiguous by origin blocks, which fragmented in data device
+type fragmentedSource struct {
+	n, next int64
+}
+
+func (this *fragmentedSource) Next() (Block, bool, error) {
+	if this.next == this.n {
+		return Block{}, false, nil
+	}
+	block := Block{OriginOffset: this.next * 10, DataOffset: this.next * 20, Length: 10}
+	this.next++
+	return block, true, nil
+}
+
+func TestCoalesceMaxBlocks(t *testing.T) {
+	const n = 2*coalesceMaxBlocks + 10
+	iter := Coalesce(DiffSources(BlockArr{}.Source(), &fragmentedSource{n: n}))
+	var lengths []int64
+	for {
+		change, ok, err := iter.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if len(change.To) > coalesceMaxBlocks {
+			t.Error(len(change.To))
+		}
+		lengths = append(lengths, change.Length)
+	}
+	expected := []int64{coalesceMaxBlocks * 10, coalesceMaxBlocks * 10, 100}
+	if !reflect.DeepEqual(lengths, expected) {
+		t.Error(lengths)
+	}
+}
+
+func TestDiffSince(t *testing.T) {
+	to := BlockArr{
+		{OriginOffset: 0, DataOffset: 100, Length: 10, Time: 1},
+		{OriginOffset: 10, DataOffset: 200, Length: 10, Time: 3},
+		{OriginOffset: 20, DataOffset: 300, Length: 10, Time: 2},
+		{OriginOffset: 40, DataOffset: 400, Length: 10, Time: 5},
+	}
+	res := readAllChanges(t, Coalesce(DiffSince(to.Source(), 2)))
+	expected := []Change{
+		{Patch: Patch{Operation: WRITE, Offset: 10, Length: 20}, To: BlockArr{to[1], to[2]}},
+		{Patch: Patch{Operation: WRITE, Offset: 40, Length: 10}, To: BlockArr{to[3]}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+
+	if res = readAllChanges(t, DiffSince(to.Source(), 6)); len(res) != 0 {
+		t.Errorf("%#v", res)
+	}
+}
@@ -0,0 +1,89 @@
+package lvm_thin_diff
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Delete modes
+const (
+	DELETE_MODE_DISCARD = "discard" // deallocate range by discard or punch hole, write zeros if it isn't supported. See discardRange.
+	DELETE_MODE_ZERO    = "zero"    // write zeros
+	DELETE_MODE_SKIP    = "skip"    // do nothing
+)
+
+// Return function for delete ranges of target with mode, for ApplyOptions.DeleteRange.
+// nil mean DELETE records will be skipped.
+func NewRangeDeleter(target *os.File, mode string) (func(offset, length int64) error, error) {
+	switch mode {
+	case DELETE_MODE_DISCARD:
+		return func(offset, length int64) error {
+			return discardRange(target, offset, length)
+		}, nil
+	case DELETE_MODE_ZERO:
+		return func(offset, length int64) error {
+			return zeroRange(target, offset, length)
+		}, nil
+	case DELETE_MODE_SKIP:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown delete mode: %q", mode)
+	}
+}
+
+// Return function for ZERO records of target, for ApplyOptions.ZeroRange. It zero out range of block device or punch
+// hole in regular file, write zeros if it isn't supported.
+func NewRangeZeroer(target *os.File) func(offset, length int64) error {
+	return func(offset, length int64) error {
+		err := zeroOutFile(target, offset, length)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Can't zero out range %v-%v, write zeros: %v", offset, offset+length, err)
+		return zeroRange(target, offset, length)
+	}
+}
+
+/*
+Discard range of block device or punch hole in regular file, write zeros if it isn't supported. Block device discard
+whole units of its discard granularity only (pool blocks for dm-thin), so freed space is deallocated on target. Head and
+tail of range out of whole units are written by zeros: discard of them may be ignored and reads return old data.
+*/
+func discardRange(file *os.File, offset, length int64) error {
+	start, end, err := discardFile(file, offset, length)
+	if err != nil {
+		log.Printf("Can't discard range %v-%v, write zeros: %v", offset, offset+length, err)
+		return zeroRange(file, offset, length)
+	}
+	err = zeroRange(file, offset, start-offset)
+	if err != nil {
+		return err
+	}
+	return zeroRange(file, end, offset+length-end)
+}
+
+// Range start-end of whole units of granularity inside range, empty range at end of it if there isn't whole units
+func alignRange(offset, length, granularity int64) (start, end int64) {
+	start = (offset + granularity - 1) / granularity * granularity
+	end = (offset + length) / granularity * granularity
+	if start >= end {
+		return offset + length, offset + length
+	}
+	return start, end
+}
+
+func zeroRange(writer io.WriterAt, offset, length int64) error {
+	buf := make([]byte, minInt64(BUF_SIZE, length))
+	for length > 0 {
+		localBuf := buf[:minInt64(int64(len(buf)), length)]
+		_, err := writer.WriteAt(localBuf, offset)
+		if err != nil {
+			return fmt.Errorf("Can't write zeros to offset %v: %v", offset, err)
+		}
+		offset += int64(len(localBuf))
+		length -= int64(len(localBuf))
+	}
+	return nil
+}
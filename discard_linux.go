@@ -0,0 +1,77 @@
+package lvm_thin_diff
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	blkDiscard      = 0x1277 // BLKDISCARD from linux/fs.h
+	blkZeroOut      = 0x127f // BLKZEROOUT from linux/fs.h
+	fallocKeepSize  = 0x01   // FALLOC_FL_KEEP_SIZE from linux/falloc.h
+	fallocPunchHole = 0x02   // FALLOC_FL_PUNCH_HOLE from linux/falloc.h
+)
+
+// Discard whole units of discard granularity in range of block device or punch hole in regular file.
+// Return discarded range start-end.
+func discardFile(file *os.File, offset, length int64) (start, end int64, err error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if stat.Mode()&os.ModeDevice == 0 {
+		return offset, offset + length, syscall.Fallocate(int(file.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+	}
+
+	start, end = alignRange(offset, length, discardGranularity(stat))
+	if start == end {
+		return start, end, nil
+	}
+	return start, end, blockIoctl(file, blkDiscard, start, end-start)
+}
+
+// Discard granularity of block device from sysfs, sector size if it is unknown
+func discardGranularity(stat os.FileInfo) int64 {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return sectorSize
+	}
+	rdev := uint64(sys.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	content, err := os.ReadFile(fmt.Sprintf("/sys/dev/block/%v:%v/queue/discard_granularity", major, minor))
+	if err != nil {
+		return sectorSize
+	}
+	granularity, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil || granularity < sectorSize {
+		return sectorSize
+	}
+	return granularity
+}
+
+// Zero out range of block device (it may unmap blocks, but reads return zeros) or punch hole in regular file.
+func zeroOutFile(file *os.File, offset, length int64) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeDevice == 0 {
+		return syscall.Fallocate(int(file.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+	}
+	return blockIoctl(file, blkZeroOut, offset, length)
+}
+
+// Call ioctl with range of block device
+func blockIoctl(file *os.File, ioctl uintptr, offset, length int64) error {
+	blkRange := [2]uint64{uint64(offset), uint64(length)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), ioctl, uintptr(unsafe.Pointer(&blkRange[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
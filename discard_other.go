@@ -0,0 +1,16 @@
+//go:build !linux
+
+package lvm_thin_diff
+
+import (
+	"errors"
+	"os"
+)
+
+func discardFile(file *os.File, offset, length int64) (start, end int64, err error) {
+	return 0, 0, errors.New("Discard is not supported on this platform")
+}
+
+func zeroOutFile(file *os.File, offset, length int64) error {
+	return errors.New("Zero out is not supported on this platform")
+}
@@ -0,0 +1,97 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZeroRange(t *testing.T) {
+	target := memWriterAt("0123456789")
+	err := zeroRange(target, 2, 5)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(target) != "01\x00\x00\x00\x00\x00789" {
+		t.Errorf("%q", target)
+	}
+}
+
+func TestDiscardRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	data := bytes.Repeat([]byte{1}, 3*65536)
+	err := os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = discardRange(f, 65536, 65536)
+	f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _ := os.ReadFile(path)
+	copy(data[65536:2*65536], make([]byte, 65536))
+	if !bytes.Equal(res, data) {
+		t.Error()
+	}
+}
+
+func TestNewRangeDeleter(t *testing.T) {
+	if f, err := NewRangeDeleter(nil, DELETE_MODE_SKIP); f != nil || err != nil {
+		t.Error(err)
+	}
+	if f, err := NewRangeDeleter(nil, DELETE_MODE_ZERO); f == nil || err != nil {
+		t.Error(err)
+	}
+	if _, err := NewRangeDeleter(nil, "test"); err == nil {
+		t.Error()
+	}
+}
+
+func TestNewRangeZeroer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	data := bytes.Repeat([]byte{1}, 3*65536)
+	err := os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewRangeZeroer(f)(100, 65536)
+	f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _ := os.ReadFile(path)
+	copy(data[100:100+65536], make([]byte, 65536))
+	if !bytes.Equal(res, data) {
+		t.Error()
+	}
+}
+
+func TestAlignRange(t *testing.T) {
+	for _, test := range []struct {
+		offset, length, start, end int64
+	}{
+		{0, 1024, 0, 1024},
+		{100, 1024, 512, 1024},
+		{100, 2000, 512, 2048},
+		{512, 511, 1023, 1023},
+		{100, 500, 600, 600},
+	} {
+		if start, end := alignRange(test.offset, test.length, 512); start != test.start || end != test.end {
+			t.Error(test, start, end)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package lvm_thin_diff
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Exit statuses of Main
+const (
+	EXIT_OK               = 0
+	EXIT_ERROR            = 1 // unclassified error
+	EXIT_USAGE            = 2 // bad command line arguments
+	EXIT_METADATA         = 3 // can't read or parse metadata
+	EXIT_DEVICE_NOT_FOUND = 4 // dev_id not found in metadata
+	EXIT_DATA_READ        = 5 // can't read data device
+	EXIT_OUTPUT_WRITE     = 6 // can't write output file or target device
+	EXIT_PATCH            = 7 // patch is broken or doesn't match target
+)
+
+type UsageError struct {
+	Message string
+}
+
+func (this *UsageError) Error() string {
+	return "Usage error: " + this.Message
+}
+
+type MetadataError struct {
+	Err error
+}
+
+func (this *MetadataError) Error() string {
+	return "Metadata error: " + this.Err.Error()
+}
+
+func (this *MetadataError) Unwrap() error {
+	return this.Err
+}
+
+type DeviceNotFoundError struct {
+	Id        int
+	Available []int // dev_ids from metadata
+}
+
+func (this *DeviceNotFoundError) Error() string {
+	available := make([]string, len(this.Available))
+	for i, id := range this.Available {
+		available[i] = strconv.Itoa(id)
+	}
+	return fmt.Sprintf("Device with dev_id %v not found in metadata, available dev_ids: %v", this.Id, strings.Join(available, ", "))
+}
+
+type DataReadError struct {
+	Err error
+}
+
+func (this *DataReadError) Error() string {
+	return "Data read error: " + this.Err.Error()
+}
+
+func (this *DataReadError) Unwrap() error {
+	return this.Err
+}
+
+type OutputWriteError struct {
+	Err error
+}
+
+func (this *OutputWriteError) Error() string {
+	return "Output write error: " + this.Err.Error()
+}
+
+func (this *OutputWriteError) Unwrap() error {
+	return this.Err
+}
+
+type PatchError struct {
+	Err error
+}
+
+func (this *PatchError) Error() string {
+	return "Patch error: " + this.Err.Error()
+}
+
+func (this *PatchError) Unwrap() error {
+	return this.Err
+}
+
+func exitCode(err error) int {
+	var usageError *UsageError
+	var metadataError *MetadataError
+	var deviceNotFoundError *DeviceNotFoundError
+	var dataReadError *DataReadError
+	var outputWriteError *OutputWriteError
+	var patchError *PatchError
+
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &usageError):
+		return EXIT_USAGE
+	case errors.As(err, &metadataError):
+		return EXIT_METADATA
+	case errors.As(err, &deviceNotFoundError):
+		return EXIT_DEVICE_NOT_FOUND
+	case errors.As(err, &dataReadError):
+		return EXIT_DATA_READ
+	case errors.As(err, &outputWriteError):
+		return EXIT_OUTPUT_WRITE
+	case errors.As(err, &patchError):
+		return EXIT_PATCH
+	default:
+		return EXIT_ERROR
+	}
+}
@@ -0,0 +1,30 @@
+package lvm_thin_diff
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	testErr := errors.New("test")
+	table := []struct {
+		err  error
+		code int
+	}{
+		{nil, EXIT_OK},
+		{testErr, EXIT_ERROR},
+		{&UsageError{"test"}, EXIT_USAGE},
+		{&MetadataError{testErr}, EXIT_METADATA},
+		{&DeviceNotFoundError{1, []int{2, 3}}, EXIT_DEVICE_NOT_FOUND},
+		{&DataReadError{testErr}, EXIT_DATA_READ},
+		{&OutputWriteError{testErr}, EXIT_OUTPUT_WRITE},
+		{&PatchError{testErr}, EXIT_PATCH},
+		{fmt.Errorf("wrap: %w", &PatchError{testErr}), EXIT_PATCH},
+	}
+	for _, test := range table {
+		if code := exitCode(test.err); code != test.code {
+			t.Errorf("%v: %v != %v", test.err, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"io"
+)
+
+type ExportOptions struct {
+	BufSize    int  // max size of data buffer, BUF_SIZE if 0
+	DetectZero bool // doesn't write data buffers with zeros only, for keep image sparse
+}
+
+/*
+Write data of device blocks to image at origin offsets. Data read from data - pool data device. Unmapped ranges
+aren't written, so new image file is sparse. Return origin end of last block - image must be extended to it
+(or to device size) by caller, if last ranges unmapped or skipped as zero.
+*/
+func ExportImage(ctx context.Context, image io.WriterAt, data io.ReaderAt, blocks BlockSource, opts ExportOptions) (end int64, err error) {
+	bufSize := int64(opts.BufSize)
+	if bufSize == 0 {
+		bufSize = BUF_SIZE
+	}
+	buf := make([]byte, bufSize)
+	for {
+		block, ok, err := blocks.Next()
+		if err != nil {
+			return end, err
+		}
+		if !ok {
+			return end, nil
+		}
+		for writedBytes := int64(0); writedBytes < block.Length; {
+			if err = ctx.Err(); err != nil {
+				return end, err
+			}
+			localBuf := buf[:minInt64(bufSize, block.Length-writedBytes)]
+			_, err = data.ReadAt(localBuf, block.DataOffset+writedBytes)
+			if err != nil {
+				return end, &DataReadError{Err: err}
+			}
+			if !opts.DetectZero || !isZero(localBuf) {
+				_, err = image.WriteAt(localBuf, block.OriginOffset+writedBytes)
+				if err != nil {
+					return end, &OutputWriteError{Err: err}
+				}
+			}
+			writedBytes += int64(len(localBuf))
+		}
+		end = maxInt64(end, block.OriginLast())
+	}
+}
@@ -0,0 +1,49 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestExportImage(t *testing.T) {
+	data := testData()
+	dev := &Device{Id: 1, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 100, Length: 100},
+		{OriginOffset: 300, DataOffset: 0, Length: 50},
+		{OriginOffset: 400, DataOffset: 600, Length: 50},
+	}}
+	const size = 500
+
+	image := memWriterAt(bytes.Repeat([]byte{7}, size))
+	end, err := ExportImage(context.Background(), image, bytes.NewReader(data), dev.Blocks.Source(), ExportOptions{BufSize: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != 450 {
+		t.Error(end)
+	}
+	expected := deviceImage(data, dev, size)
+	for _, r := range [][2]int{{100, 300}, {350, 400}, {450, 500}} {
+		copy(expected[r[0]:r[1]], bytes.Repeat([]byte{7}, r[1]-r[0]))
+	}
+	if !bytes.Equal(image, expected) {
+		t.Error()
+	}
+
+	// Zero buffers skipped
+	image = memWriterAt(bytes.Repeat([]byte{7}, size))
+	_, err = ExportImage(context.Background(), image, bytes.NewReader(data), dev.Blocks.Source(), ExportOptions{DetectZero: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[400:450], bytes.Repeat([]byte{7}, 50))
+	if !bytes.Equal(image, expected) {
+		t.Error()
+	}
+
+	_, err = ExportImage(context.Background(), image, bytes.NewReader(data[:500]), dev.Blocks.Source(), ExportOptions{})
+	if exitCode(err) != EXIT_DATA_READ {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,461 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	PATCH_FORMAT_STREAM  = "stream"  // gob stream, see patch.go. Readed sequentially.
+	PATCH_FORMAT_INDEXED = "indexed" // data chunks with index in footer, for random access
+
+	indexedMagic    = "LTDINDX1"
+	indexFooterSize = 3*8 + len(indexedMagic)
+)
+
+/*
+Indexed patch format:
+indexedMagic
+Data chunks: stored bytes of WRITE data buffers (compressed by codec, then encrypted), one after another
+patchIndex (gob)
+patchTrailer (gob), Sum is sha256 of encoded patchIndex, MAC authenticate index of encrypted patch
+indexFooter (big endian)
+Every chunk is encrypted with its number as nonce counter, so it can be decrypted without read other chunks.
+*/
+
+// Record of index: WRITE record with one data chunk, or ZERO or DELETE record without data
+type indexExtent struct {
+	Operation  int
+	Offset     int64             // origin offset
+	Length     int64             // origin length, decoded length of data chunk
+	FileOffset int64             // offset of stored data chunk in patch file
+	FileLength int64             // length of stored data chunk
+	Sum        [sha256.Size]byte // sha256 of stored data chunk
+	Chunk      uint64            // number of data chunk, nonce counter for encryption
+}
+
+type patchIndex struct {
+	Header  patchHeader
+	Summary patchSummary
+	Extents []indexExtent // in origin order, without overlaps
+}
+
+// Fixed size end of indexed patch, for find index
+type indexFooter struct {
+	IndexOffset   uint64
+	IndexLength   uint64
+	TrailerLength uint64
+	Magic         [len(indexedMagic)]byte
+}
+
+type indexedWriter struct {
+	writer     io.Writer
+	codec      Codec
+	cipher     *chunkCipher
+	signKey    ed25519.PrivateKey // sign index by the key, if not nil
+	saveShared bool               // save shared ranges to summary
+	index      patchIndex
+	fileOffset int64  // offset of next data chunk in patch file
+	dataOffset int64  // origin offset of next data chunk
+	chunks     uint64 // count of written data chunks
+}
+
+// Write magic of indexed patch. If key isn't nil - data chunks will be encrypted by it.
+func newIndexedWriter(writer io.Writer, header patchHeader, key *Key) (*indexedWriter, error) {
+	res := &indexedWriter{writer: writer}
+	var err error
+	res.codec, err = getCodec(header.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		res.cipher, err = key.newHeaderCipher(&header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.index.Header = header
+	_, err = io.WriteString(writer, indexedMagic)
+	if err != nil {
+		return nil, err
+	}
+	res.fileOffset = int64(len(indexedMagic))
+	return res, nil
+}
+
+func (this *indexedWriter) WritePatch(patch Patch) error {
+	this.dataOffset = patch.Offset
+	if patch.Operation != WRITE {
+		this.index.Extents = append(this.index.Extents, indexExtent{Operation: patch.Operation, Offset: patch.Offset, Length: patch.Length})
+	}
+	return nil
+}
+
+// Write data chunk and add WRITE extent for it
+func (this *indexedWriter) WriteData(buf []byte) error {
+	length := int64(len(buf))
+	if this.codec != nil {
+		var err error
+		buf, err = this.codec.Encode(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if this.cipher != nil {
+		buf = this.cipher.SealChunk(this.chunks, this.dataOffset, buf)
+	}
+	_, err := this.writer.Write(buf)
+	if err != nil {
+		return err
+	}
+	this.index.Extents = append(this.index.Extents, indexExtent{
+		Operation:  WRITE,
+		Offset:     this.dataOffset,
+		Length:     length,
+		FileOffset: this.fileOffset,
+		FileLength: int64(len(buf)),
+		Sum:        sha256.Sum256(buf),
+		Chunk:      this.chunks,
+	})
+	this.chunks++
+	this.fileOffset += int64(len(buf))
+	this.dataOffset += length
+	return nil
+}
+
+func (this *indexedWriter) AddShared(blocks BlockArr) {
+	this.index.Summary.add(blocks, this.saveShared)
+}
+
+// Write index, trailer and footer. Doesn't close underlying writer.
+func (this *indexedWriter) Close() error {
+	if !this.saveShared {
+		this.index.Summary.Shared = nil
+	}
+	indexBuf := &bytes.Buffer{}
+	err := gob.NewEncoder(indexBuf).Encode(this.index)
+	if err != nil {
+		return err
+	}
+	trailer := patchTrailer{Sum: sha256.Sum256(indexBuf.Bytes())}
+	if this.signKey != nil {
+		trailer.Signature = signPatchSum(this.signKey, trailer.Sum)
+	}
+	if this.cipher != nil {
+		trailer.MAC = trailerMAC(this.cipher, trailer.Sum)
+	}
+	trailerBuf := &bytes.Buffer{}
+	err = gob.NewEncoder(trailerBuf).Encode(trailer)
+	if err != nil {
+		return err
+	}
+
+	footer := indexFooter{
+		IndexOffset:   uint64(this.fileOffset),
+		IndexLength:   uint64(indexBuf.Len()),
+		TrailerLength: uint64(trailerBuf.Len()),
+	}
+	copy(footer.Magic[:], indexedMagic)
+	for _, buf := range [][]byte{indexBuf.Bytes(), trailerBuf.Bytes()} {
+		_, err = this.writer.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return binary.Write(this.writer, binary.BigEndian, footer)
+}
+
+// Write indexed patch with changes from iter, see WritePatch. Writer is written sequentially, index is written after
+// data. Doesn't close writer.
+func WriteIndexedPatch(ctx context.Context, writer io.Writer, data io.ReaderAt, iter Iterator, opts WriteOptions) error {
+	header, err := newWriteHeader(opts)
+	if err != nil {
+		return err
+	}
+	indexedWriter, err := newIndexedWriter(writer, header, opts.Key)
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	indexedWriter.signKey = opts.SignKey
+	indexedWriter.saveShared = opts.SharedRanges
+	return writeRecords(ctx, indexedWriter, data, iter, opts)
+}
+
+// Indexed patch, opened for random access. Only index is readed on open, data chunks are readed on demand.
+type IndexedPatch struct {
+	reader  io.ReaderAt
+	index   patchIndex
+	trailer patchTrailer
+	codec   Codec
+	cipher  *chunkCipher // nil if key isn't given
+
+	mu           sync.Mutex
+	cachedExtent indexExtent // extent of last decoded data chunk
+	cachedData   []byte
+}
+
+// Check magic of indexed patch
+func IsIndexedPatch(reader io.ReaderAt) bool {
+	buf := make([]byte, len(indexedMagic))
+	_, err := reader.ReadAt(buf, 0)
+	return err == nil && string(buf) == indexedMagic
+}
+
+// Open indexed patch of size bytes: read and check index. Key is needed for read data of encrypted patch and for
+// authenticate its index, without it only checksums can be verified.
+func OpenIndexedPatch(reader io.ReaderAt, size int64, key *Key) (*IndexedPatch, error) {
+	if size < int64(len(indexedMagic)+indexFooterSize) || !IsIndexedPatch(reader) {
+		return nil, &PatchError{Err: errors.New("It isn't indexed patch")}
+	}
+	var footer indexFooter
+	err := binary.Read(io.NewSectionReader(reader, size-int64(indexFooterSize), int64(indexFooterSize)), binary.BigEndian, &footer)
+	if err != nil {
+		return nil, &PatchError{Err: errors.New("Can't read index footer: " + err.Error())}
+	}
+	indexEnd := uint64(size) - uint64(indexFooterSize)
+	if string(footer.Magic[:]) != indexedMagic || footer.IndexOffset < uint64(len(indexedMagic)) ||
+		footer.IndexOffset > indexEnd || footer.IndexLength > indexEnd || footer.TrailerLength > indexEnd ||
+		footer.IndexOffset+footer.IndexLength+footer.TrailerLength != indexEnd {
+		return nil, &PatchError{Err: errors.New("Bad index footer, patch may be truncated")}
+	}
+
+	res := &IndexedPatch{reader: reader}
+	indexBuf := make([]byte, footer.IndexLength)
+	_, err = reader.ReadAt(indexBuf, int64(footer.IndexOffset))
+	if err != nil {
+		return nil, &PatchError{Err: errors.New("Can't read patch index: " + err.Error())}
+	}
+	trailerReader := io.NewSectionReader(reader, int64(footer.IndexOffset+footer.IndexLength), int64(footer.TrailerLength))
+	err = gob.NewDecoder(trailerReader).Decode(&res.trailer)
+	if err != nil {
+		return nil, &PatchError{Err: errors.New("Can't read patch trailer: " + err.Error())}
+	}
+	if sum := sha256.Sum256(indexBuf); sum != res.trailer.Sum {
+		return nil, &PatchError{Err: fmt.Errorf("Index checksum mismatch: %x != %x", sum, res.trailer.Sum)}
+	}
+	err = gob.NewDecoder(bytes.NewReader(indexBuf)).Decode(&res.index)
+	if err != nil {
+		return nil, &PatchError{Err: errors.New("Can't read patch index: " + err.Error())}
+	}
+	res.codec, res.cipher, err = res.index.Header.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if res.cipher != nil && !hmac.Equal(res.trailer.MAC, trailerMAC(res.cipher, res.trailer.Sum)) {
+		return nil, &PatchError{Err: errors.New("Index authentication failed, it may be changed without key")}
+	}
+	err = res.checkExtents(int64(footer.IndexOffset))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Check order of extents and place of data chunks before dataEnd
+func (this *IndexedPatch) checkExtents(dataEnd int64) error {
+	var last int64
+	for _, ext := range this.index.Extents {
+		switch ext.Operation {
+		case DELETE, ZERO:
+			// pass
+		case WRITE:
+			if ext.FileOffset < int64(len(indexedMagic)) || ext.FileLength < 0 || ext.FileOffset+ext.FileLength > dataEnd {
+				return &PatchError{Err: fmt.Errorf("Data of extent at offset %v out of data area", ext.Offset)}
+			}
+		default:
+			return &PatchError{Err: fmt.Errorf("Unknown patch operation: %v", ext.Operation)}
+		}
+		if ext.Offset < last || ext.Length <= 0 || ext.Offset+ext.Length > this.index.Header.Size {
+			return &PatchError{Err: fmt.Errorf("Bad extent in index: offset %v, length %v", ext.Offset, ext.Length)}
+		}
+		last = ext.Offset + ext.Length
+	}
+	return nil
+}
+
+// Size of origin device
+func (this *IndexedPatch) Size() int64 {
+	return this.index.Header.Size
+}
+
+// Header fields and extents of patch, as InspectPatch for patch stream. Extent of WRITE is one data chunk.
+func (this *IndexedPatch) Info() *PatchInfo {
+	header := this.index.Header
+	info := &PatchInfo{
+		Format:        PATCH_FORMAT_INDEXED,
+		Version:       header.Version,
+		BlockSize:     header.BlockSize,
+		FromDevId:     header.FromDevId,
+		ToDevId:       header.ToDevId,
+		Size:          header.Size,
+		Codec:         header.Codec,
+		Encryption:    header.Encryption,
+		KeyId:         header.KeyId,
+		Signed:        len(this.trailer.Signature) > 0,
+		SharedExtents: this.index.Summary.SharedExtents,
+		SharedBytes:   this.index.Summary.SharedBytes,
+		Operations:    make(map[string]OperationStats),
+		Extents:       []Extent{},
+	}
+	for _, ext := range this.index.Extents {
+		name := OperationName(ext.Operation)
+		stats := info.Operations[name]
+		stats.Count++
+		stats.Bytes += ext.Length
+		info.Operations[name] = stats
+		info.Extents = append(info.Extents, Extent{Operation: name, Offset: ext.Offset, Length: ext.Length})
+		info.DataBytes += ext.FileLength
+	}
+	return info
+}
+
+// Check if index signed by one of trusted keys
+func (this *IndexedPatch) CheckSignature(trustedKeys []ed25519.PublicKey) error {
+	return checkPatchSignature(this.trailer, trustedKeys)
+}
+
+/*
+Check data chunks of extents, which intersect origin range from offset with length bytes. length <= 0 mean up to end of
+device. Data is decrypted and decoded if patch isn't encrypted or key is given, else only checksums are checked.
+*/
+func (this *IndexedPatch) Verify(ctx context.Context, offset, length int64) error {
+	end := this.index.Header.Size
+	if length > 0 {
+		end = offset + length
+	}
+	for _, ext := range this.findExtents(offset, end) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ext.Operation != WRITE {
+			continue
+		}
+		var err error
+		if this.index.Header.Encryption != "" && this.cipher == nil {
+			_, err = this.readRawChunk(ext)
+		} else {
+			_, err = this.readChunk(ext)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ReadAt read origin range, changed by patch: data of WRITE records, zeros for ZERO and DELETE records and for ranges,
+which patch doesn't change. For patch from empty base it is content of device. Read after Size return io.EOF.
+Safe for concurrent use.
+*/
+func (this *IndexedPatch) ReadAt(p []byte, off int64) (n int, err error) {
+	size := this.index.Header.Size
+	if off < 0 {
+		return 0, &PatchError{Err: fmt.Errorf("Negative read offset: %v", off)}
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	end := off + int64(len(p))
+	for _, ext := range this.findExtents(off, end) {
+		if ext.Operation != WRITE {
+			continue
+		}
+		data, readErr := this.cachedChunk(ext)
+		if readErr != nil {
+			return 0, readErr
+		}
+		start, last := maxInt64(ext.Offset, off), minInt64(ext.Offset+ext.Length, end)
+		copy(p[start-off:last-off], data[start-ext.Offset:last-ext.Offset])
+	}
+	return len(p), err
+}
+
+// Extents, which intersect origin range [offset, end)
+func (this *IndexedPatch) findExtents(offset, end int64) []indexExtent {
+	extents := this.index.Extents
+	first := sort.Search(len(extents), func(i int) bool {
+		return extents[i].Offset+extents[i].Length > offset
+	})
+	count := sort.Search(len(extents)-first, func(i int) bool {
+		return extents[first+i].Offset >= end
+	})
+	return extents[first : first+count]
+}
+
+// Decoded data of extent, last decoded chunk is cached for sequential reads by small buffers
+func (this *IndexedPatch) cachedChunk(ext indexExtent) ([]byte, error) {
+	this.mu.Lock()
+	if this.cachedData != nil && this.cachedExtent == ext {
+		data := this.cachedData
+		this.mu.Unlock()
+		return data, nil
+	}
+	this.mu.Unlock()
+
+	data, err := this.readChunk(ext)
+	if err != nil {
+		return nil, err
+	}
+	this.mu.Lock()
+	this.cachedExtent, this.cachedData = ext, data
+	this.mu.Unlock()
+	return data, nil
+}
+
+// Read data chunk of extent and check its checksum
+func (this *IndexedPatch) readRawChunk(ext indexExtent) ([]byte, error) {
+	buf := make([]byte, ext.FileLength)
+	_, err := this.reader.ReadAt(buf, ext.FileOffset)
+	if err != nil {
+		return nil, &PatchError{Err: fmt.Errorf("Can't read data for offset %v: %v", ext.Offset, err)}
+	}
+	if sha256.Sum256(buf) != ext.Sum {
+		return nil, &PatchError{Err: fmt.Errorf("Data checksum mismatch at offset %v", ext.Offset)}
+	}
+	return buf, nil
+}
+
+// Read data chunk of extent, decrypt and decode it
+func (this *IndexedPatch) readChunk(ext indexExtent) ([]byte, error) {
+	if this.index.Header.Encryption != "" && this.cipher == nil {
+		return nil, &PatchError{Err: errors.New("Patch is encrypted, key is needed for read data")}
+	}
+	buf, err := this.readRawChunk(ext)
+	if err != nil {
+		return nil, err
+	}
+	if this.cipher != nil {
+		buf, err = this.cipher.OpenChunk(ext.Chunk, ext.Offset, buf)
+		if err != nil {
+			return nil, &PatchError{Err: fmt.Errorf("Can't decrypt data for offset %v: %v", ext.Offset, err)}
+		}
+	}
+	if this.codec != nil {
+		buf, err = this.codec.Decode(buf, ext.Length)
+		if err != nil {
+			return nil, &PatchError{Err: fmt.Errorf("Can't decode data for offset %v: %v", ext.Offset, err)}
+		}
+	}
+	if int64(len(buf)) != ext.Length {
+		return nil, &PatchError{Err: fmt.Errorf("Data length mismatch at offset %v", ext.Offset)}
+	}
+	return buf, nil
+}
@@ -0,0 +1,156 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestIndexedPatch(t *testing.T) {
+	data := testData()
+	from, to := testDevices()
+	to.Blocks = append(to.Blocks, Block{OriginOffset: 300, DataOffset: 200, Length: 100})
+	key, err := NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signPublic, signKey, _ := ed25519.GenerateKey(nil)
+
+	buf := &bytes.Buffer{}
+	opts := WriteOptions{BlockSize: 50, FromDevId: 1, ToDevId: 2, Size: 400, BufSize: 40, DetectZero: true, Codec: "gzip", Key: key, SignKey: signKey}
+	err = WriteIndexedPatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(from, to)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchData := buf.Bytes()
+	if !IsIndexedPatch(bytes.NewReader(patchData)) {
+		t.Error()
+	}
+
+	patch, err := OpenIndexedPatch(bytes.NewReader(patchData), int64(len(patchData)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := patch.Info()
+	if info.Format != PATCH_FORMAT_INDEXED || info.Version != patchVersion || info.FromDevId != 1 || info.ToDevId != 2 ||
+		info.Size != 400 || info.Codec != "gzip" || info.Encryption == "" || !info.Signed ||
+		info.SharedExtents != 1 || info.SharedBytes != 100 {
+		t.Errorf("%#v", info)
+	}
+	expectedExtents := []Extent{
+		{Operation: "WRITE", Offset: 100, Length: 40},
+		{Operation: "WRITE", Offset: 140, Length: 10},
+		{Operation: "ZERO", Offset: 150, Length: 50},
+		{Operation: "DELETE", Offset: 200, Length: 100},
+		{Operation: "WRITE", Offset: 300, Length: 40},
+		{Operation: "WRITE", Offset: 340, Length: 40},
+		{Operation: "WRITE", Offset: 380, Length: 20},
+	}
+	if !reflect.DeepEqual(info.Extents, expectedExtents) {
+		t.Errorf("%#v", info.Extents)
+	}
+	if err = patch.CheckSignature([]ed25519.PublicKey{signPublic}); err != nil {
+		t.Error(err)
+	}
+
+	// Content of changed ranges, zeros for other
+	expected := make([]byte, 400)
+	copy(expected[100:150], data[300:350])
+	copy(expected[300:400], data[200:300])
+	res, err := io.ReadAll(io.NewSectionReader(patch, 0, 1000))
+	if err != nil || !bytes.Equal(res, expected) {
+		t.Error(err, res)
+	}
+	part := make([]byte, 30)
+	if n, err := patch.ReadAt(part, 130); n != 30 || err != nil || !bytes.Equal(part, expected[130:160]) {
+		t.Error(n, err, part)
+	}
+	if n, err := patch.ReadAt(part, 390); n != 10 || err != io.EOF || !bytes.Equal(part[:10], expected[390:]) {
+		t.Error(n, err)
+	}
+
+	if err = patch.Verify(context.Background(), 0, 0); err != nil {
+		t.Error(err)
+	}
+
+	// Checksums only without key
+	patchWithoutKey, err := OpenIndexedPatch(bytes.NewReader(patchData), int64(len(patchData)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = patchWithoutKey.Verify(context.Background(), 0, 0); err != nil {
+		t.Error(err)
+	}
+	if _, err = patchWithoutKey.ReadAt(part, 100); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+
+	// Index changed without key
+	forged := &bytes.Buffer{}
+	dataEnd := patch.index.Extents[len(patch.index.Extents)-1].FileOffset + patch.index.Extents[len(patch.index.Extents)-1].FileLength
+	forged.Write(patchData[:dataEnd])
+	w := &indexedWriter{writer: forged, fileOffset: dataEnd, index: patch.index}
+	w.index.Extents = append([]indexExtent{}, patch.index.Extents...)
+	w.index.Extents[0].Operation = ZERO
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenIndexedPatch(bytes.NewReader(forged.Bytes()), int64(forged.Len()), key); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+	if _, err = OpenIndexedPatch(bytes.NewReader(forged.Bytes()), int64(forged.Len()), nil); err != nil {
+		t.Error(err)
+	}
+
+	// Broken chunk is detected by verify of its range only
+	broken := append([]byte{}, patchData...)
+	broken[patch.index.Extents[4].FileOffset] ^= 1
+	patch, err = OpenIndexedPatch(bytes.NewReader(broken), int64(len(broken)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = patch.Verify(context.Background(), 0, 300); err != nil {
+		t.Error(err)
+	}
+	if err = patch.Verify(context.Background(), 290, 20); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+
+	// Truncated and stream patch
+	if _, err = OpenIndexedPatch(bytes.NewReader(patchData), int64(len(patchData)-1), key); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+	buf.Reset()
+	err = WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(from, to)), WriteOptions{BlockSize: 50, Size: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsIndexedPatch(bytes.NewReader(buf.Bytes())) {
+		t.Error()
+	}
+}
+
+func TestIndexedPatchFindExtents(t *testing.T) {
+	patch := &IndexedPatch{index: patchIndex{Extents: []indexExtent{
+		{Offset: 0, Length: 10},
+		{Offset: 20, Length: 10},
+		{Offset: 30, Length: 10},
+	}}}
+	for _, test := range []struct {
+		offset, end int64
+		expected    []indexExtent
+	}{
+		{0, 5, patch.index.Extents[:1]},
+		{10, 20, patch.index.Extents[1:1]},
+		{9, 21, patch.index.Extents[:2]},
+		{25, 100, patch.index.Extents[1:]},
+		{40, 100, patch.index.Extents[3:]},
+	} {
+		if res := patch.findExtents(test.offset, test.end); !reflect.DeepEqual(res, test.expected) {
+			t.Error(test.offset, test.end, res)
+		}
+	}
+}
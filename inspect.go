@@ -0,0 +1,124 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Name of patch operation
+func OperationName(operation int) string {
+	switch operation {
+	case NONE:
+		return "NONE"
+	case WRITE:
+		return "WRITE"
+	case DELETE:
+		return "DELETE"
+	case END:
+		return "END"
+	case ZERO:
+		return "ZERO"
+	default:
+		return fmt.Sprintf("UNKNOWN(%v)", operation)
+	}
+}
+
+// Statistic of records of one operation
+type OperationStats struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"` // origin bytes, which changed by records
+}
+
+// Patch record with origin range
+type Extent struct {
+	Operation string `json:"operation"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+}
+
+// Content of patch without data
+type PatchInfo struct {
+	Format        string                    `json:"format"` // PATCH_FORMAT_STREAM or PATCH_FORMAT_INDEXED
+	Version       int                       `json:"version"`
+	BlockSize     int64                     `json:"block_size"`
+	FromDevId     int                       `json:"from_dev_id"`
+	ToDevId       int                       `json:"to_dev_id"`
+	Size          int64                     `json:"size"`
+	Codec         string                    `json:"codec"`
+	Encryption    string                    `json:"encryption"`
+	KeyId         string                    `json:"key_id"`
+	Signed        bool                      `json:"signed"`
+	SharedExtents int64                     `json:"shared_extents"` // unchanged ranges, NONE records before version 6
+	SharedBytes   int64                     `json:"shared_bytes"`   // unknown before version 6
+	DataBytes     int64                     `json:"data_bytes"`     // size of stored data, after compression and encryption. Decoded size for compressed patch before version 4.
+	Operations    map[string]OperationStats `json:"operations"`
+	Extents       []Extent                  `json:"extents"` // records with origin ranges, in patch order
+}
+
+// Read full patch and collect its content. Checksums are checked, data isn't decrypted.
+func InspectPatch(ctx context.Context, reader io.Reader) (*PatchInfo, error) {
+	patchReader, err := newPatchReader(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	header := patchReader.Header
+	info := &PatchInfo{
+		Format:     PATCH_FORMAT_STREAM,
+		Version:    header.Version,
+		BlockSize:  header.BlockSize,
+		FromDevId:  header.FromDevId,
+		ToDevId:    header.ToDevId,
+		Size:       header.Size,
+		Codec:      header.Codec,
+		Encryption: header.Encryption,
+		KeyId:      header.KeyId,
+		Operations: make(map[string]OperationStats),
+		Extents:    []Extent{},
+	}
+	countData := func(offset int64, buf []byte) error {
+		info.DataBytes += int64(len(buf))
+		return nil
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		patch, err := patchReader.Next()
+		if err == io.EOF {
+			info.Signed = len(patchReader.Trailer.Signature) > 0
+			info.SharedExtents = patchReader.Summary.SharedExtents
+			info.SharedBytes = patchReader.Summary.SharedBytes
+			return info, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := OperationName(patch.Operation)
+		stats := info.Operations[name]
+		stats.Count++
+		stats.Bytes += patch.Length
+		info.Operations[name] = stats
+		if patch.Length > 0 {
+			info.Extents = append(info.Extents, Extent{Operation: name, Offset: patch.Offset, Length: patch.Length})
+		}
+
+		switch patch.Operation {
+		case DELETE, ZERO:
+			// pass
+		case WRITE:
+			if header.Version < 4 && header.Codec != "" {
+				// Chunks hasn't decoded length before version 4, they can be splitted by records only after decode
+				err = patchReader.ReadData(patch, countData)
+			} else {
+				err = patchReader.ReadRawData(patch, countData)
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &PatchError{Err: fmt.Errorf("Unknown patch operation: %v", patch.Operation)}
+		}
+	}
+}
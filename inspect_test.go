@@ -0,0 +1,68 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+)
+
+func TestInspectPatch(t *testing.T) {
+	data := testData()
+	from, to := testDevices()
+	key, err := NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, signKey, _ := ed25519.GenerateKey(nil)
+
+	buf := &bytes.Buffer{}
+	opts := WriteOptions{BlockSize: 50, FromDevId: 1, ToDevId: 2, Size: 300, DetectZero: true, Codec: "gzip", Key: key, SignKey: signKey}
+	err = WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(from, to)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchSize := buf.Len()
+
+	info, err := InspectPatch(context.Background(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != patchVersion || info.BlockSize != 50 || info.FromDevId != 1 || info.ToDevId != 2 || info.Size != 300 ||
+		info.Codec != "gzip" || info.Encryption == "" || info.KeyId == "" || !info.Signed {
+		t.Errorf("%#v", info)
+	}
+	if info.SharedExtents != 1 || info.SharedBytes != 100 {
+		t.Error(info.SharedExtents, info.SharedBytes)
+	}
+	if info.DataBytes <= 0 || info.DataBytes >= int64(patchSize) {
+		t.Error(info.DataBytes)
+	}
+	expectedOperations := map[string]OperationStats{
+		"WRITE":  {Count: 1, Bytes: 50},
+		"ZERO":   {Count: 1, Bytes: 50},
+		"DELETE": {Count: 1, Bytes: 100},
+	}
+	if !reflect.DeepEqual(info.Operations, expectedOperations) {
+		t.Errorf("%#v", info.Operations)
+	}
+	expectedExtents := []Extent{
+		{Operation: "WRITE", Offset: 100, Length: 50},
+		{Operation: "ZERO", Offset: 150, Length: 50},
+		{Operation: "DELETE", Offset: 200, Length: 100},
+	}
+	if !reflect.DeepEqual(info.Extents, expectedExtents) {
+		t.Errorf("%#v", info.Extents)
+	}
+
+	if _, err = InspectPatch(context.Background(), bytes.NewReader([]byte("test"))); exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	if OperationName(WRITE) != "WRITE" || OperationName(100) != "UNKNOWN(100)" {
+		t.Error()
+	}
+}
@@ -1,11 +1,18 @@
 package lvm_thin_diff
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"strconv"
 	"strings"
 	"os"
+	"os/signal"
 	"io"
 	"encoding/gob"
+	"encoding/json"
+	"text/tabwriter"
 	"time"
 	"log"
 )
@@ -14,26 +21,69 @@ const (
 	BUF_SIZE = 4*1024*1024 // bytes
 )
 
+var cli = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
 var (
-	MetadataDumpFile = flag.String("metadata-dump-file", "", "Path to xml metadata file from thin-dump")
-	Output = flag.String("output", "-", "Path to output file. '-' mean stdout")
-	Operation = flag.String("operation", "", "makediff. makediff - create diff of snapshots")
-	FromDevId = flag.Int("from-dev-id", 0, "DevID of old snapshot")
-	ToDevId = flag.Int("to-dev-id", 0, "DevID of new snapshot")
-	DataFile = flag.String("data-file", "", "path to device or file with underliing data")
-	CacheFile = flag.String("cache-file", "", "use file for cache tmp calcs, for example xml parse")
+	MetadataDumpFile = cli.String("metadata-dump-file", "", "Path to xml metadata file from thin-dump, or metadata device/image for binary format")
+	MetadataFormat = cli.String("metadata-format", "xml", "Format of metadata-dump-file: xml, binary, thin_delta. xml - output of thin_dump, binary - thin pool metadata device or its copy, thin_delta - output of thin_delta --verbose for makediff")
+	MetadataSnap = cli.Bool("metadata-snap", false, "Read metadata snapshot of live pool, for binary metadata format")
+	Output = cli.String("output", "-", "Path to output file. '-' mean stdout")
+	Operation = cli.String("operation", "", "makediff, applydiff, verifypatch, checksig, checkmetadata, listdevices, export, inspect, plan, extract. makediff - create diff of snapshots, applydiff - apply diff to target, verifypatch - check patch integrity, checksig - check patch integrity and signature, checkmetadata - check structure of xml metadata and print problems, listdevices - print devices of pool, export - export to-dev-id as raw image or full patch, inspect - print content of patch, plan - print size of diff by metadata only, without read data-file, extract - write range of indexed patch as raw data")
+	FromDevId = devIdFlag("from-dev-id", 0, "DevID of old snapshot. 'none' mean empty base: makediff create full image of new snapshot, applydiff apply it to empty target")
+	ToDevId = cli.Int("to-dev-id", 0, "DevID of new snapshot")
+	DataFile = cli.String("data-file", "", "path to device or file with underliing data")
+	CacheFile = cli.String("cache-file", "", "use file for cache tmp calcs, for example xml parse")
+	Input = cli.String("input", "-", "Path to input patch file. '-' mean stdin")
+	Target = cli.String("target", "", "path to device or image file for apply patch")
+	DeleteMode = cli.String("delete-mode", DELETE_MODE_DISCARD, "How apply DELETE records: discard, zero, skip. discard - discard device range (partial blocks of discard granularity are written by zeros) or punch hole in file, write zeros if not supported, zero - write zeros, skip - do nothing")
+	Compress = cli.String("compress", "", "Codec for compress patch data: gzip, zlib, flate. Empty for uncompressed patch")
+	KeyFile = cli.String("key-file", "", "Path to file with encryption key: 32 bytes or 64 hex digits. Patch data will be encrypted by AES-GCM")
+	PassphraseFile = cli.String("passphrase-file", "", "Path to file with passphrase for encryption, alternative to key-file")
+	SignKey = cli.String("sign-key", "", "Path to Ed25519 private key in PEM (PKCS #8) for sign patch")
+	TrustedKeys = cli.String("trusted-keys", "", "Path to PEM file with Ed25519 public keys, which trusted for checksig")
+	SinceTime = cli.Int64("since-time", -1, "Incremental makediff by mapping times, base snapshot isn't needed in metadata: patch contains blocks of to-dev-id, which written at the pool time or later. Use snap_time of base snapshot (see listdevices), from-dev-id is only written to patch header. Discarded blocks can't be detected in this mode, so patch hasn't DELETE records. -1 - disabled")
+	CompareData = cli.Bool("compare-content", false, "makediff read data of changed blocks from both snapshots and doesn't write blocks with equal data. Patch may be much smaller for rewrites of same data, but makediff read twice more")
+	DetectZero = cli.Bool("detect-zero", true, "makediff write ZERO records without data for data buffers with zeros only. applydiff zero out such ranges of target")
+	SharedRanges = cli.Bool("shared-ranges", false, "makediff save origin ranges of unchanged data to patch summary. By default only count and size of them are saved")
+	PatchFormat = cli.String("patch-format", PATCH_FORMAT_STREAM, "Format of patch for makediff and export: stream, indexed. indexed - data chunks with index in footer, for extract, selective verifypatch and inspect without read full patch. applydiff support stream only")
+	RangeOffset = cli.Int64("range-offset", 0, "Origin offset of range for extract and verifypatch of indexed patch")
+	RangeLength = cli.Int64("range-length", 0, "Length of range for extract and verifypatch of indexed patch. 0 mean up to end of device")
+	ExportFormat = cli.String("export-format", "raw", "Format of export: raw, patch. raw - sparse image file with data of device, patch - patch from empty base")
+	JSONOutput = cli.Bool("json", false, "Print result of listdevices, inspect and plan in JSON")
+	DeviceSize = cli.Int64("device-size", 0, "Size of origin device in bytes, for patch header. 0 mean end of last mapped block")
 )
 
 var (
 	globalCache struct{
 		MetadataTimeStamp *time.Time
-		Devices           []dataDevice
+		Pool              *Pool
 	}
 )
 
+/*
+Main is command line wrapper for library. It run operation from command line flags and exit with status:
+0 - OK
+1 - unclassified error
+2 - bad command line arguments
+3 - can't read or parse metadata
+4 - dev_id not found in metadata
+5 - can't read data device
+6 - can't write output file or target device
+7 - patch is broken or doesn't match target
+*/
 func Main(){
-	flag.Parse()
+	cli.Parse(os.Args[1:])
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx)
+	cancel()
+	if err != nil {
+		log.Println(err)
+	}
+	os.Exit(exitCode(err))
+}
+
+func run(ctx context.Context) error {
 	if *CacheFile != "" {
 		f, _ := os.Open(*CacheFile)
 		errLocal := gob.NewDecoder(f).Decode(&globalCache)
@@ -45,9 +95,30 @@ func Main(){
 		}
 	}
 
+	var err error
 	switch strings.ToLower(*Operation) {
 	case "makediff":
-		makeDiff()
+		err = makeDiff(ctx)
+	case "applydiff":
+		err = applyDiff(ctx)
+	case "verifypatch":
+		err = verifyPatchFile(ctx)
+	case "checksig":
+		err = checkSignatureFile(ctx)
+	case "checkmetadata":
+		err = checkMetadataFile()
+	case "listdevices":
+		err = listDevices()
+	case "export":
+		err = exportDevice(ctx)
+	case "inspect":
+		err = inspectPatchFile(ctx)
+	case "plan":
+		err = diffMetadata(ctx, printPlan)
+	case "extract":
+		err = extractRange(ctx)
+	default:
+		return &UsageError{Message: "Unknown operation: '" + *Operation + "'"}
 	}
 
 	if *CacheFile != "" {
@@ -60,129 +131,863 @@ func Main(){
 			log.Println("Cache save error:", errLocal)
 		}
 	}
+	return err
 }
 
-
-func makeDiff(){
-	var err error
-	var writer io.WriteCloser
-	if *Output == "-"{
-		writer = os.Stdout
-	} else {
-		writer, err = os.OpenFile(*Output, os.O_WRONLY | os.O_TRUNC | os.O_CREATE, 0600)
+// Load metadata from cache or parse it from MetadataDumpFile
+func loadMetadata() (*Pool, error) {
+	switch *MetadataFormat {
+	case "xml":
+		// pass
+	case "binary":
+		// Metadata of live pool change without change mtime of device, so it doesn't cached.
+		log.Println("Read binary metadata")
+		f, err := os.Open(*MetadataDumpFile)
+		if err != nil {
+			return nil, &MetadataError{Err: err}
+		}
+		defer f.Close()
+		pool, err := ReadBinaryMetadata(f, *MetadataSnap)
 		if err != nil {
-			panic(err)
+			return nil, &MetadataError{Err: err}
 		}
+		return pool, nil
+	default:
+		return nil, &UsageError{Message: "Unknown metadata format: '" + *MetadataFormat + "'"}
 	}
-	defer writer.Close()
-	enc := gob.NewEncoder(writer)
 
-	reader, err := os.OpenFile(*DataFile, os.O_RDONLY, 0600)
+	stat, err := os.Stat(*MetadataDumpFile)
 	if err != nil {
-		panic(err)
+		return nil, &MetadataError{Err: err}
 	}
-
-	var devices []dataDevice = nil
-	if globalCache.MetadataTimeStamp != nil && len(globalCache.Devices) > 0 {
-		stat, _ := os.Stat(*MetadataDumpFile)
+	if globalCache.MetadataTimeStamp != nil && globalCache.Pool != nil {
 		if stat.ModTime() == *globalCache.MetadataTimeStamp {
-			devices = globalCache.Devices
-			log.Println("Load devices from cache", len(devices))
+			log.Println("Load devices from cache", len(globalCache.Pool.Devices))
+			return globalCache.Pool, nil
 		}
 	}
-	if devices == nil {
-		log.Println("Parse xml metadata")
-		f, err := os.Open(*MetadataDumpFile)
 
+	err = validateMetadataFile()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Parse xml metadata")
+	f, err := os.Open(*MetadataDumpFile)
+	if err != nil {
+		return nil, &MetadataError{Err: err}
+	}
+	defer f.Close()
+
+	pool, err := ParseMetadata(f)
+	if err != nil {
+		return nil, &MetadataError{Err: err}
+	}
+
+	statTime := stat.ModTime()
+	globalCache.MetadataTimeStamp = &statTime
+	globalCache.Pool = pool
+	return pool, nil
+}
+
+// Consumer of diff: write patch or print plan
+type diffOutput func(ctx context.Context, iter Iterator, opts WriteOptions) error
+
+func makeDiff(ctx context.Context) error {
+	return diffMetadata(ctx, writePatchFile)
+}
+
+// Make diff from-dev-id to to-dev-id from metadata of any format and pass it to output
+func diffMetadata(ctx context.Context, output diffOutput) error {
+	if *MetadataFormat == "thin_delta" {
+		if *SinceTime >= 0 {
+			return &UsageError{Message: "since-time can't be used with thin_delta metadata format"}
+		}
+		return makeDiffFromThinDelta(ctx, output)
+	}
+	return makeDiffDevices(ctx, *FromDevId, *ToDevId, output)
+}
+
+// Make diff of devices from xml or binary metadata
+func makeDiffDevices(ctx context.Context, fromDevId, toDevId int, output diffOutput) error {
+	if *MetadataFormat == "xml" && *CacheFile == "" {
+		return makeDiffStreaming(ctx, fromDevId, toDevId, output)
+	}
+
+	pool, err := loadMetadata()
+	if err != nil {
+		return err
+	}
+	to, err := pool.Device(toDevId)
+	if err != nil {
+		return err
+	}
+	opts := WriteOptions{
+		BlockSize: pool.BlockSize,
+		FromDevId: fromDevId,
+		ToDevId:   to.Id,
+		Size:      *DeviceSize,
+	}
+	if *SinceTime >= 0 {
+		// Base snapshot isn't needed in metadata
+		if opts.Size == 0 {
+			opts.Size = to.Blocks.OriginLast()
+		}
+		return output(ctx, Coalesce(DiffSince(to.Blocks.Source(), *SinceTime)), opts)
+	}
+
+	from, err := pool.Device(fromDevId)
+	if err != nil {
+		return err
+	}
+	if opts.Size == 0 {
+		opts.Size = maxInt64(from.Blocks.OriginLast(), to.Blocks.OriginLast())
+	}
+	return output(ctx, Coalesce(Diff(from, to)), opts)
+}
+
+// Make diff from thin_dump xml without load metadata to memory: mappings of every device are readed by own pass over
+// the file.
+func makeDiffStreaming(ctx context.Context, fromDevId, toDevId int, output diffOutput) error {
+	err := validateMetadataFile()
+	if err != nil {
+		return err
+	}
+
+	opts := WriteOptions{
+		FromDevId: fromDevId,
+		ToDevId:   toDevId,
+		Size:      *DeviceSize,
+	}
+	devIds := []int{opts.FromDevId, opts.ToDevId}
+	if *SinceTime >= 0 {
+		// Base snapshot isn't needed in metadata
+		devIds = []int{opts.ToDevId}
+	}
+	if opts.Size == 0 {
+		// Header must be written before changes, so find end of devices by separate pass.
+		log.Println("Scan xml metadata for device size")
+		f, err := os.Open(*MetadataDumpFile)
+		if err != nil {
+			return &MetadataError{Err: err}
+		}
+		var ends map[int]int64
+		ends, err = XMLDevicesEnd(f, devIds...)
+		f.Close()
 		if err != nil {
-			panic(err)
+			return wrapMetadataError(err)
+		}
+		for _, devId := range devIds {
+			opts.Size = maxInt64(opts.Size, ends[devId])
 		}
+	}
+
+	to, err := openXMLBlockSource(opts.ToDevId)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	opts.BlockSize = to.BlockSize
+	if *SinceTime >= 0 {
+		return output(ctx, Coalesce(DiffSince(to, *SinceTime)), opts)
+	}
+
+	from, err := openXMLBlockSource(opts.FromDevId)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	return output(ctx, Coalesce(DiffSources(from, to)), opts)
+}
+
+// XMLBlockSource of MetadataDumpFile, which close the file
+type xmlBlockSourceFile struct {
+	*XMLBlockSource
+	file *os.File
+}
+
+func openXMLBlockSource(devId int) (*xmlBlockSourceFile, error) {
+	f, err := os.Open(*MetadataDumpFile)
+	if err != nil {
+		return nil, &MetadataError{Err: err}
+	}
+	src, err := NewXMLBlockSource(f, devId)
+	if err != nil {
+		f.Close()
+		return nil, &MetadataError{Err: err}
+	}
+	return &xmlBlockSourceFile{XMLBlockSource: src, file: f}, nil
+}
+
+func (this *xmlBlockSourceFile) Next() (block Block, ok bool, err error) {
+	block, ok, err = this.XMLBlockSource.Next()
+	if err != nil {
+		err = wrapMetadataError(err)
+	}
+	return block, ok, err
+}
+
+func (this *xmlBlockSourceFile) Close() error {
+	return this.file.Close()
+}
+
+// Wrap error of metadata read to MetadataError. DeviceNotFoundError is returned as is.
+func wrapMetadataError(err error) error {
+	var deviceNotFoundError *DeviceNotFoundError
+	if errors.As(err, &deviceNotFoundError) {
+		return err
+	}
+	return &MetadataError{Err: err}
+}
 
-		devices, err = parseMetaDataXML(f)
+// Check structure of xml MetadataDumpFile. Return InvalidMetadataError, wrapped to MetadataError, if it has problems.
+func validateMetadataFile() error {
+	log.Println("Validate xml metadata")
+	f, err := os.Open(*MetadataDumpFile)
+	if err != nil {
+		return &MetadataError{Err: err}
+	}
+	defer f.Close()
+	problems, err := ValidateMetadata(f)
+	if err != nil {
+		return &MetadataError{Err: err}
+	}
+	if len(problems) > 0 {
+		return &MetadataError{Err: &InvalidMetadataError{Problems: problems}}
+	}
+	return nil
+}
+
+// Print problems of xml MetadataDumpFile to Output
+func checkMetadataFile() error {
+	if *MetadataFormat != "xml" {
+		return &UsageError{Message: "checkmetadata support only xml metadata format"}
+	}
+	err := validateMetadataFile()
+	var invalidMetadataError *InvalidMetadataError
+	if !errors.As(err, &invalidMetadataError) {
+		if err == nil {
+			log.Println("Metadata OK")
+		}
+		return err
+	}
+
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	for _, problem := range invalidMetadataError.Problems {
+		_, err = fmt.Fprintln(writer, problem)
 		if err != nil {
-			panic(err)
+			return &OutputWriteError{Err: err}
+		}
+	}
+	return &MetadataError{Err: fmt.Errorf("Metadata has %v problems", len(invalidMetadataError.Problems))}
+}
+
+// Print devices of pool to Output: table or JSON
+func listDevices() error {
+	pool, err := loadMetadata()
+	if err != nil {
+		return err
+	}
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if *JSONOutput {
+		type jsonDevice struct {
+			DevId        int   `json:"dev_id"`
+			MappedBlocks int64 `json:"mapped_blocks"`
+			MappedBytes  int64 `json:"mapped_bytes"`
+			Transaction  int64 `json:"transaction"`
+			CreationTime int64 `json:"creation_time"`
+			SnapTime     int64 `json:"snap_time"`
+		}
+		res := struct {
+			UUID         string       `json:"uuid"`
+			Time         int64        `json:"time"`
+			Transaction  int64        `json:"transaction"`
+			BlockSize    int64        `json:"block_size"`
+			NrDataBlocks int64        `json:"nr_data_blocks"`
+			Devices      []jsonDevice `json:"devices"`
+		}{pool.UUID, pool.Time, pool.Transaction, pool.BlockSize, pool.NrDataBlocks, []jsonDevice{}}
+		for _, dev := range pool.Devices {
+			res.Devices = append(res.Devices, jsonDevice{dev.Id, dev.MappedBlocks, dev.MappedBlocks * pool.BlockSize,
+				dev.Transaction, dev.CreationTime, dev.SnapTime})
 		}
+		enc := json.NewEncoder(writer)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	} else {
+		table := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "DEV_ID\tMAPPED_BLOCKS\tMAPPED_BYTES\tTRANSACTION\tCREATION_TIME\tSNAP_TIME")
+		for _, dev := range pool.Devices {
+			fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\n", dev.Id, dev.MappedBlocks, dev.MappedBlocks*pool.BlockSize,
+				dev.Transaction, dev.CreationTime, dev.SnapTime)
+		}
+		err = table.Flush()
+	}
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
 
-		stat, _ := os.Stat(*MetadataDumpFile)
-		statTime := stat.ModTime()
-		globalCache.MetadataTimeStamp = &statTime
-		globalCache.Devices = devices
+// Export to-dev-id to Output: sparse raw image or patch from empty base
+func exportDevice(ctx context.Context) error {
+	if *MetadataFormat == "thin_delta" {
+		return &UsageError{Message: "export doesn't support thin_delta metadata format"}
+	}
+	switch *ExportFormat {
+	case "patch":
+		if *SinceTime >= 0 {
+			return &UsageError{Message: "since-time can't be used for export"}
+		}
+		return makeDiffDevices(ctx, NONE_DEV_ID, *ToDevId, writePatchFile)
+	case "raw":
+		// pass
+	default:
+		return &UsageError{Message: "Unknown export format: '" + *ExportFormat + "'"}
+	}
+	if *Output == "-" {
+		return &UsageError{Message: "raw export need output file"}
 	}
 
-	var from, to dataDevice
-	for _, dev := range devices {
-		if dev.Id == *FromDevId {
-			from = dev
+	var blocks BlockSource
+	if *MetadataFormat == "xml" && *CacheFile == "" {
+		err := validateMetadataFile()
+		if err != nil {
+			return err
+		}
+		src, err := openXMLBlockSource(*ToDevId)
+		if err != nil {
+			return err
 		}
-		if dev.Id == *ToDevId {
-			to = dev
+		defer src.Close()
+		blocks = src
+	} else {
+		pool, err := loadMetadata()
+		if err != nil {
+			return err
 		}
+		dev, err := pool.Device(*ToDevId)
+		if err != nil {
+			return err
+		}
+		blocks = dev.Blocks.Source()
 	}
 
-	cutter := newDataBlockArrCutter(from.Blocks, to.Blocks)
-	buf := make([]byte, BUF_SIZE)
+	reader, err := os.Open(*DataFile)
+	if err != nil {
+		return &DataReadError{Err: err}
+	}
+	defer reader.Close()
+
+	image, err := os.OpenFile(*Output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	defer image.Close()
+	stat, err := image.Stat()
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	if !stat.Mode().IsRegular() {
+		// Unmapped ranges aren't written, they would keep old data of device
+		return &UsageError{Message: "raw export need regular output file, use patch format for devices"}
+	}
+
+	end, err := ExportImage(ctx, image, reader, blocks, ExportOptions{DetectZero: *DetectZero})
+	if err != nil {
+		return err
+	}
+	err = image.Truncate(maxInt64(end, *DeviceSize))
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	err = image.Close()
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
+
+// Make diff from output of thin_delta --verbose
+func makeDiffFromThinDelta(ctx context.Context, output diffOutput) error {
+	f, err := os.Open(*MetadataDumpFile)
+	if err != nil {
+		return &MetadataError{Err: err}
+	}
+	defer f.Close()
+	delta, err := NewThinDeltaReader(f)
+	if err != nil {
+		return &MetadataError{Err: err}
+	}
+	if isFlagSet("from-dev-id") && *FromDevId != delta.Left || isFlagSet("to-dev-id") && *ToDevId != delta.Right {
+		return &UsageError{Message: "thin_delta is diff between devices " + strconv.Itoa(delta.Left) + " and " + strconv.Itoa(delta.Right)}
+	}
+
+	opts := WriteOptions{
+		BlockSize: delta.BlockSize,
+		FromDevId: delta.Left,
+		ToDevId:   delta.Right,
+		Size:      *DeviceSize,
+	}
+	if opts.Size == 0 {
+		// Header must be written before changes, so read delta twice.
+		opts.Size, err = thinDeltaSize(ctx, *MetadataDumpFile)
+		if err != nil {
+			return err
+		}
+	}
+	return output(ctx, Coalesce(delta), opts)
+}
+
+// End of last range of thin_delta output
+func thinDeltaSize(ctx context.Context, path string) (size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, &MetadataError{Err: err}
+	}
+	defer f.Close()
+	delta, err := NewThinDeltaReader(f)
+	if err != nil {
+		return 0, &MetadataError{Err: err}
+	}
 	for {
-		ok, bFrom, bTo := cutter.Cut()
+		change, ok, err := delta.Next(ctx)
+		if err != nil {
+			return 0, &MetadataError{Err: err}
+		}
 		if !ok {
-			return
-		}
-		diff := calcDiff(bFrom, bTo)
-		enc.Encode(diff)
-		if diff.Operation == WRITE {
-			_, err = reader.Seek(bTo.DataOffset, 0)
-			if err != nil {
-				panic(err)
-			}
-			var writedBytes int64
-			for writedBytes = 0;writedBytes < diff.Length; {
-				bytesForRead := diff.Length - writedBytes
-				localBuf := buf[:minInt64(BUF_SIZE, bytesForRead)]
-				_, err := reader.Read(localBuf)
-				if err != nil {
-					panic(err)
-				}
-				err = enc.Encode(localBuf)
-				if err != nil {
-					panic(err)
-				}
-				writedBytes += int64(len(localBuf))
-			}
-			if writedBytes != diff.Length {
-				panic("writedBytes != diff.Length")
-			}
+			return size, nil
 		}
+		size = maxInt64(size, maxInt64(change.From.OriginLast(), change.To.OriginLast()))
 	}
 }
 
-/*
-Создать команду для патча данных from так чтобы получились данные to.
-bFrom и bTo - два блока данных. Если оба блока не пустые - то они должны начинаться с одного логического смещения и
-быть равной длины.
+// Write patch with changes from iter to Output, data read from DataFile. Options for compress, encrypt and sign
+// patch are filled from flags.
+func writePatchFile(ctx context.Context, iter Iterator, opts WriteOptions) error {
+	var err error
+	writePatch := WritePatch
+	switch *PatchFormat {
+	case PATCH_FORMAT_STREAM:
+		// pass
+	case PATCH_FORMAT_INDEXED:
+		writePatch = WriteIndexedPatch
+	default:
+		return &UsageError{Message: "Unknown patch format: '" + *PatchFormat + "'"}
+	}
+	opts.Codec = *Compress
+	opts.CompareContent = *CompareData
+	opts.DetectZero = *DetectZero
+	opts.SharedRanges = *SharedRanges
+	opts.Key, err = loadKey()
+	if err != nil {
+		return err
+	}
+	if *SignKey != "" {
+		opts.SignKey, err = LoadSignKeyFile(*SignKey)
+		if err != nil {
+			return &UsageError{Message: "Can't load sign key: " + err.Error()}
+		}
+	}
 
-Пустой блок означает что в месте, указанном вторым блоком данных нет.
-*/
-func calcDiff(bFrom, bTo dataBlock) dataPatch {
-	if bFrom.IsEmpty() && bTo.IsEmpty() {
-		return dataPatch{Operation: NONE}
+	reader, err := os.OpenFile(*DataFile, os.O_RDONLY, 0600)
+	if err != nil {
+		return &DataReadError{Err: err}
+	}
+	defer reader.Close()
+
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	return writePatch(ctx, writer, reader, iter, opts)
+}
+
+// Load encryption key from KeyFile or PassphraseFile. Return nil key if no one set.
+func loadKey() (key *Key, err error) {
+	switch {
+	case *KeyFile != "" && *PassphraseFile != "":
+		return nil, &UsageError{Message: "key-file and passphrase-file can't be used together"}
+	case *KeyFile != "":
+		key, err = LoadKeyFile(*KeyFile)
+	case *PassphraseFile != "":
+		key, err = LoadPassphraseFile(*PassphraseFile)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &UsageError{Message: "Can't load key: " + err.Error()}
+	}
+	return key, nil
+}
+
+func openOutput() (io.WriteCloser, error) {
+	if *Output == "-" {
+		return os.Stdout, nil
+	}
+	writer, err := os.OpenFile(*Output, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, &OutputWriteError{Err: err}
+	}
+	return writer, nil
+}
+
+// Open Input as indexed patch. Return nil patch without error if Input isn't indexed patch file.
+func openIndexedInput(key *Key) (*IndexedPatch, io.Closer, error) {
+	if *Input == "-" {
+		return nil, nil, nil
+	}
+	f, err := os.Open(*Input)
+	if err != nil {
+		return nil, nil, &PatchError{Err: err}
+	}
+	if !IsIndexedPatch(f) {
+		f.Close()
+		return nil, nil, nil
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, nil, &PatchError{Err: err}
+	}
+	patch, err := OpenIndexedPatch(f, size, key)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return patch, f, nil
+}
+
+// Check range flags, which used for indexed patch only
+func checkRangeFlags(indexed bool) error {
+	if !indexed && (isFlagSet("range-offset") || isFlagSet("range-length")) {
+		return &UsageError{Message: "range-offset and range-length can be used with indexed patch file only"}
+	}
+	if *RangeOffset < 0 || *RangeLength < 0 {
+		return &UsageError{Message: "range-offset and range-length can't be negative"}
+	}
+	return nil
+}
+
+func openInput() (io.ReadCloser, error) {
+	if *Input == "-" {
+		return os.Stdin, nil
+	}
+	reader, err := os.Open(*Input)
+	if err != nil {
+		return nil, &PatchError{Err: err}
+	}
+	return reader, nil
+}
+
+func applyDiff(ctx context.Context) error {
+	if !isFlagSet("from-dev-id") {
+		return &UsageError{Message: "from-dev-id must be set to DevID of snapshot, which contained in target"}
+	}
+
+	key, err := loadKey()
+	if err != nil {
+		return err
 	}
 
-	if bFrom.IsEmpty() {
-		return dataPatch{Offset: bTo.OriginOffset, Operation: WRITE, Length: bTo.Length}
+	indexed, closer, err := openIndexedInput(nil)
+	if err != nil {
+		return err
+	}
+	if indexed != nil {
+		closer.Close()
+		return &UsageError{Message: "applydiff support stream patch format only"}
+	}
+	reader, err := openInput()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	target, err := os.OpenFile(*Target, os.O_WRONLY, 0600)
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	defer target.Close()
+
+	opts := ApplyOptions{FromDevId: *FromDevId, Key: key}
+	opts.TargetSize, err = target.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	opts.ZeroRange = NewRangeZeroer(target)
+	opts.DeleteRange, err = NewRangeDeleter(target, *DeleteMode)
+	if err != nil {
+		return &UsageError{Message: err.Error()}
 	}
 
-	if bTo.IsEmpty() {
-		return dataPatch{Offset: bFrom.OriginOffset, Operation: DELETE, Length: bFrom.Length}
+	err = ApplyPatch(ctx, reader, target, opts)
+	if err != nil {
+		return err
+	}
+	err = target.Sync()
+	if err != nil {
+		return &OutputWriteError{Err: err}
 	}
+	return nil
+}
 
-	if bFrom.OriginOffset != bTo.OriginOffset || bFrom.Length != bTo.Length {
-		panic("bFrom and bTo must have same start and length")
+func verifyPatchFile(ctx context.Context) error {
+	key, err := loadKey()
+	if err != nil {
+		return err
+	}
+
+	patch, closer, err := openIndexedInput(key)
+	if err != nil {
+		return err
+	}
+	if err = checkRangeFlags(patch != nil); err != nil {
+		return err
+	}
+	if patch != nil {
+		defer closer.Close()
+		err = patch.Verify(ctx, *RangeOffset, *RangeLength)
+		if err != nil {
+			return err
+		}
+		log.Println("Patch OK")
+		return nil
 	}
 
-	if bFrom.DataOffset == bTo.DataOffset {
-		return dataPatch{Operation: NONE} // Data is equal. Do nothing.
+	reader, err := openInput()
+	if err != nil {
+		return err
 	}
+	defer reader.Close()
 
-	return dataPatch{Offset: bTo.OriginOffset, Operation: WRITE, Length: bTo.Length}
+	err = VerifyPatch(ctx, reader, VerifyOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	log.Println("Patch OK")
+	return nil
+}
+
+func checkSignatureFile(ctx context.Context) error {
+	if *TrustedKeys == "" {
+		return &UsageError{Message: "trusted-keys must be set for checksig"}
+	}
+	trustedKeys, err := LoadTrustedKeysFile(*TrustedKeys)
+	if err != nil {
+		return &UsageError{Message: "Can't load trusted keys: " + err.Error()}
+	}
+	key, err := loadKey()
+	if err != nil {
+		return err
+	}
+
+	patch, closer, err := openIndexedInput(key)
+	if err != nil {
+		return err
+	}
+	if err = checkRangeFlags(patch != nil); err != nil {
+		return err
+	}
+	if patch != nil {
+		// Signature cover index with checksums of all data chunks
+		defer closer.Close()
+		err = patch.CheckSignature(trustedKeys)
+		if err == nil {
+			err = patch.Verify(ctx, *RangeOffset, *RangeLength)
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("Patch signature OK")
+		return nil
+	}
+
+	reader, err := openInput()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	err = VerifyPatch(ctx, reader, VerifyOptions{Key: key, TrustedKeys: trustedKeys})
+	if err != nil {
+		return err
+	}
+	log.Println("Patch signature OK")
+	return nil
+}
+
+// Print plan of diff to Output: text or JSON. Data isn't readed.
+func printPlan(ctx context.Context, iter Iterator, opts WriteOptions) error {
+	plan, err := PlanDiff(ctx, iter)
+	if err != nil {
+		return err
+	}
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if *JSONOutput {
+		enc := json.NewEncoder(writer)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(plan)
+	} else {
+		table := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(table, "From dev_id:\t%v\n", opts.FromDevId)
+		fmt.Fprintf(table, "To dev_id:\t%v\n", opts.ToDevId)
+		fmt.Fprintf(table, "Size:\t%v\n", opts.Size)
+		fmt.Fprintf(table, "Extents:\t%v\n", plan.WriteExtents+plan.DeleteExtents)
+		fmt.Fprintf(table, "Write extents:\t%v\n", plan.WriteExtents)
+		fmt.Fprintf(table, "Write bytes:\t%v\n", plan.WriteBytes)
+		fmt.Fprintf(table, "Delete extents:\t%v\n", plan.DeleteExtents)
+		fmt.Fprintf(table, "Delete bytes:\t%v\n", plan.DeleteBytes)
+		fmt.Fprintf(table, "Shared bytes:\t%v\n", plan.SharedBytes)
+		err = table.Flush()
+	}
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
+
+// Print header, statistic and extents of Input patch to Output: text or JSON
+func inspectPatchFile(ctx context.Context) error {
+	info, err := inspectInput(ctx)
+	if err != nil {
+		return err
+	}
+
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if *JSONOutput {
+		enc := json.NewEncoder(writer)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(info)
+	} else {
+		err = printPatchInfo(writer, info)
+	}
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
+
+// Read info of indexed patch from its index, or read full patch stream
+func inspectInput(ctx context.Context) (*PatchInfo, error) {
+	patch, closer, err := openIndexedInput(nil)
+	if err != nil {
+		return nil, err
+	}
+	if patch != nil {
+		defer closer.Close()
+		return patch.Info(), nil
+	}
+
+	reader, err := openInput()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return InspectPatch(ctx, reader)
+}
+
+// Write range of indexed Input patch to Output: data of changed ranges, zeros for other
+func extractRange(ctx context.Context) error {
+	key, err := loadKey()
+	if err != nil {
+		return err
+	}
+	patch, closer, err := openIndexedInput(key)
+	if err != nil {
+		return err
+	}
+	if patch == nil {
+		return &UsageError{Message: "extract need indexed patch file in input"}
+	}
+	defer closer.Close()
+	if err = checkRangeFlags(true); err != nil {
+		return err
+	}
+	end := patch.Size()
+	if *RangeLength > 0 {
+		end = *RangeOffset + *RangeLength
+	}
+	if end > patch.Size() {
+		return &UsageError{Message: "Range is out of device size " + strconv.FormatInt(patch.Size(), 10)}
+	}
+
+	writer, err := openOutput()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	buf := make([]byte, BUF_SIZE)
+	for offset := *RangeOffset; offset < end; {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		n, err := patch.ReadAt(buf[:minInt64(BUF_SIZE, end-offset)], offset)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(buf[:n])
+		if err != nil {
+			return &OutputWriteError{Err: err}
+		}
+		offset += int64(n)
+	}
+	return nil
+}
+
+func printPatchInfo(writer io.Writer, info *PatchInfo) error {
+	orNone := func(s string) string {
+		if s == "" {
+			return "none"
+		}
+		return s
+	}
+	table := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "Format:\t%v\n", info.Format)
+	fmt.Fprintf(table, "Version:\t%v\n", info.Version)
+	fmt.Fprintf(table, "Block size:\t%v\n", info.BlockSize)
+	fmt.Fprintf(table, "From dev_id:\t%v\n", info.FromDevId)
+	fmt.Fprintf(table, "To dev_id:\t%v\n", info.ToDevId)
+	fmt.Fprintf(table, "Size:\t%v\n", info.Size)
+	fmt.Fprintf(table, "Codec:\t%v\n", orNone(info.Codec))
+	fmt.Fprintf(table, "Encryption:\t%v\n", orNone(info.Encryption))
+	fmt.Fprintf(table, "Signed:\t%v\n", info.Signed)
+	fmt.Fprintf(table, "Data bytes:\t%v\n", info.DataBytes)
+	fmt.Fprintf(table, "Shared extents:\t%v\n", info.SharedExtents)
+	fmt.Fprintf(table, "Shared bytes:\t%v\n", info.SharedBytes)
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "OPERATION\tCOUNT\tBYTES")
+	for _, op := range []int{WRITE, ZERO, DELETE} {
+		if stats, ok := info.Operations[OperationName(op)]; ok {
+			fmt.Fprintf(table, "%v\t%v\t%v\n", OperationName(op), stats.Count, stats.Bytes)
+		}
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "OPERATION\tOFFSET\tLENGTH")
+	for _, extent := range info.Extents {
+		fmt.Fprintf(table, "%v\t%v\t%v\n", extent.Operation, extent.Offset, extent.Length)
+	}
+	return table.Flush()
 }
 
 func minInt64(a,b int64) int64 {
@@ -191,4 +996,54 @@ func minInt64(a,b int64) int64 {
 	} else {
 		return b
 	}
-}
\ No newline at end of file
+}
+
+func maxInt64(a,b int64) int64 {
+	if a > b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// Flag value of dev_id, which can be 'none' for NONE_DEV_ID
+type devIdValue int
+
+func (this *devIdValue) String() string {
+	if *this == NONE_DEV_ID {
+		return "none"
+	}
+	return strconv.Itoa(int(*this))
+}
+
+func (this *devIdValue) Set(s string) error {
+	if s == "none" {
+		*this = NONE_DEV_ID
+		return nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if id < 0 {
+		return errors.New("dev_id must be non negative or 'none'")
+	}
+	*this = devIdValue(id)
+	return nil
+}
+
+func devIdFlag(name string, value int, usage string) *int {
+	p := new(int)
+	*p = value
+	cli.Var((*devIdValue)(p), name, usage)
+	return p
+}
+
+func isFlagSet(name string) (res bool) {
+	cli.Visit(func(f *flag.Flag){
+		if f.Name == name {
+			res = true
+		}
+	})
+	return res
+}
@@ -3,21 +3,28 @@ package lvm_thin_diff
 import (
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
 )
 
 const sectorSize = 512 // bytes in sector
 
-func parseMetaDataXML(reader io.Reader) ([]dataDevice, error) {
-	arr := []dataDevice{}
+// Parse xml metadata from thin_dump. If devIds set - parse only the devices, other devices are skipped without
+// read their mappings to memory.
+func ParseMetadata(reader io.Reader, devIds ...int) (*Pool, error) {
+	return parseMetaDataXML(reader, devIds...)
+}
+
+func parseMetaDataXML(reader io.Reader, devIds ...int) (*Pool, error) {
+	pool := &Pool{Devices: []Device{}}
 	xmlReader := xml.NewDecoder(reader)
-	var dev *dataDevice
+	var dev *Device
 	var blockSize int64 = 0
 	for {
 		token, err := xmlReader.Token()
 		if err != nil {
-			return arr, errors.New("Parse token error: " + err.Error())
+			return pool, errors.New("Parse token error: " + err.Error())
 		}
 		switch t := token.(type) {
 		case xml.StartElement:
@@ -25,56 +32,129 @@ func parseMetaDataXML(reader io.Reader) ([]dataDevice, error) {
 			case "superblock":
 				blockSize, err = strconv.ParseInt(getAttr(t.Attr, "data_block_size"), 10, 64)
 				if err != nil {
-					return arr, errors.New("Can't parse blockSize: " + err.Error())
+					return pool, errors.New("Can't parse blockSize: " + err.Error())
 				}
 				blockSize *= sectorSize
-			case "device":
-				arr = append(arr, dataDevice{})
-				dev = &arr[len(arr)-1]
-				dev.Id, err = strconv.Atoi(getAttr(t.Attr, "dev_id"))
+				pool.BlockSize = blockSize
+				pool.UUID = getAttr(t.Attr, "uuid")
+				err = parseInt64Attrs(t.Attr, map[string]*int64{
+					"time":           &pool.Time,
+					"transaction":    &pool.Transaction,
+					"nr_data_blocks": &pool.NrDataBlocks,
+				})
 				if err != nil {
-					return arr, errors.New("Can't parse device id: " + getAttr(t.Attr, "dev_id"))
+					return pool, errors.New("Can't parse superblock: " + err.Error())
 				}
-			case "single_mapping":
-				dev.Blocks = append(dev.Blocks, dataBlock{Length:blockSize})
-				block := &dev.Blocks[len(dev.Blocks)-1]
-				block.OriginOffset, err = strconv.ParseInt(getAttr(t.Attr, "origin_block"), 10, 64)
-				block.OriginOffset *= blockSize
+			case "device":
+				id, err := strconv.Atoi(getAttr(t.Attr, "dev_id"))
 				if err != nil {
-					return arr, errors.New("Can't parse single_mapping block origin offset '" + getAttr(t.Attr, "origin_block") + "' :" + err.Error())
+					return pool, errors.New("Can't parse device id: " + getAttr(t.Attr, "dev_id"))
+				}
+				if len(devIds) > 0 && !containsInt(devIds, id) {
+					pool.Skipped = append(pool.Skipped, id)
+					err = xmlReader.Skip()
+					if err != nil {
+						return pool, errors.New("Parse token error: " + err.Error())
+					}
+					continue
 				}
-				block.DataOffset, err = strconv.ParseInt(getAttr(t.Attr, "data_block"), 10, 64)
-				block.DataOffset *= blockSize
+				pool.Devices = append(pool.Devices, Device{Id: id})
+				dev = &pool.Devices[len(pool.Devices)-1]
+				err = parseInt64Attrs(t.Attr, map[string]*int64{
+					"mapped_blocks": &dev.MappedBlocks,
+					"transaction":   &dev.Transaction,
+					"creation_time": &dev.CreationTime,
+					"snap_time":     &dev.SnapTime,
+				})
 				if err != nil {
-					return arr, errors.New("Can't parse single_mapping block data offset '" + getAttr(t.Attr, "data_block") + "' :" + err.Error())
+					return pool, fmt.Errorf("Can't parse device %v: %v", id, err)
 				}
-
-			case "range_mapping":
-				dev.Blocks = append(dev.Blocks, dataBlock{})
-				block := &dev.Blocks[len(dev.Blocks)-1]
-				block.OriginOffset, err = strconv.ParseInt(getAttr(t.Attr, "origin_begin"), 10, 64)
-				block.OriginOffset *= blockSize
-				if err != nil{
-					return arr, errors.New("Can't parse range_mapping block origin offset '" + getAttr(t.Attr, "origin_begin") + "' :" + err.Error())
+			case "single_mapping", "range_mapping":
+				if blockSize == 0 {
+					return pool, errors.New("Mapping before superblock")
 				}
-				block.DataOffset, err = strconv.ParseInt(getAttr(t.Attr, "data_begin"), 10, 64)
-				block.DataOffset *= blockSize
-				if err != nil {
-					return arr, errors.New("Can't parse range_mapping block data offset '" + getAttr(t.Attr, "data_begin") + "' :" + err.Error())
+				if dev == nil {
+					return pool, errors.New("Mapping outside of device")
 				}
-				block.Length, err = strconv.ParseInt(getAttr(t.Attr, "length"), 10, 64)
-				block.Length *= blockSize
+				block, err := parseMapping(t, blockSize)
 				if err != nil {
-					return arr, errors.New("Can't parse range_mapping length '" + getAttr(t.Attr, "length") + "': " + err.Error())
+					return pool, err
 				}
+				dev.Blocks = append(dev.Blocks, block)
 			}
 		case xml.EndElement:
-			if t.Name.Local == "superblock" {
-				return arr, nil
+			switch t.Name.Local {
+			case "device":
+				dev = nil
+			case "superblock":
+				return pool, nil
 			}
 		}
 	}
-	return arr, errors.New("Unexpected exit of funtion")
+}
+
+// Parse single_mapping or range_mapping element
+func parseMapping(t xml.StartElement, blockSize int64) (block Block, err error) {
+	switch t.Name.Local {
+	case "single_mapping":
+		block.Length = blockSize
+		block.OriginOffset, err = strconv.ParseInt(getAttr(t.Attr, "origin_block"), 10, 64)
+		block.OriginOffset *= blockSize
+		if err != nil {
+			return block, errors.New("Can't parse single_mapping block origin offset '" + getAttr(t.Attr, "origin_block") + "' :" + err.Error())
+		}
+		block.DataOffset, err = strconv.ParseInt(getAttr(t.Attr, "data_block"), 10, 64)
+		block.DataOffset *= blockSize
+		if err != nil {
+			return block, errors.New("Can't parse single_mapping block data offset '" + getAttr(t.Attr, "data_block") + "' :" + err.Error())
+		}
+	case "range_mapping":
+		block.OriginOffset, err = strconv.ParseInt(getAttr(t.Attr, "origin_begin"), 10, 64)
+		block.OriginOffset *= blockSize
+		if err != nil {
+			return block, errors.New("Can't parse range_mapping block origin offset '" + getAttr(t.Attr, "origin_begin") + "' :" + err.Error())
+		}
+		block.DataOffset, err = strconv.ParseInt(getAttr(t.Attr, "data_begin"), 10, 64)
+		block.DataOffset *= blockSize
+		if err != nil {
+			return block, errors.New("Can't parse range_mapping block data offset '" + getAttr(t.Attr, "data_begin") + "' :" + err.Error())
+		}
+		block.Length, err = strconv.ParseInt(getAttr(t.Attr, "length"), 10, 64)
+		block.Length *= blockSize
+		if err != nil {
+			return block, errors.New("Can't parse range_mapping length '" + getAttr(t.Attr, "length") + "': " + err.Error())
+		}
+	}
+	err = parseInt64Attrs(t.Attr, map[string]*int64{"time": &block.Time})
+	if err != nil {
+		return block, errors.New("Can't parse " + t.Name.Local + ": " + err.Error())
+	}
+	return block, nil
+}
+
+// Parse optional integer attributes to values. Absent attribute doesn't change value.
+func parseInt64Attrs(arr []xml.Attr, values map[string]*int64) error {
+	for _, attr := range arr {
+		value, ok := values[attr.Name.Local]
+		if !ok {
+			continue
+		}
+		var err error
+		*value, err = strconv.ParseInt(attr.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad %v '%v'", attr.Name.Local, attr.Value)
+		}
+	}
+	return nil
+}
+
+func containsInt(arr []int, val int) bool {
+	for _, item := range arr {
+		if item == val {
+			return true
+		}
+	}
+	return false
 }
 
 func getAttr(arr []xml.Attr, name string) string {
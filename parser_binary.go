@@ -0,0 +1,225 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// On-disk format of dm-thin metadata, see linux drivers/md/dm-thin-metadata.c and drivers/md/persistent-data.
+const (
+	metadataBlockSize   = 4096 // bytes
+	thinSuperblockMagic = 27022010
+
+	superblockCsumXor = 160774
+	btreeCsumXor      = 121107
+
+	btreeInternalNode   = 1
+	btreeLeafNode       = 2
+	btreeNodeHeaderSize = 32
+	btreeMaxDepth       = 32 // protection from loops in broken metadata
+
+	deviceDetailsSize = 24
+	mappingTimeBits   = 24
+)
+
+// Device details fields, offsets in bytes
+const (
+	ddMappedBlocksOffset = 0
+	ddTransactionOffset  = 8
+	ddCreationTimeOffset = 16
+	ddSnapTimeOffset     = 20
+)
+
+// Superblock fields, offsets in bytes. csum and blocknr are common for all metadata blocks.
+const (
+	sbCsumOffset              = 0
+	sbBlocknrOffset           = 8
+	sbUUIDOffset              = 16
+	sbUUIDSize                = 16
+	sbMagicOffset             = 32
+	sbTimeOffset              = 44
+	sbTransactionOffset       = 48
+	sbHeldRootOffset          = 56
+	sbNrDataBlocksOffset      = 64 // first field of data space map root
+	sbDataMappingRootOffset   = 320
+	sbDeviceDetailsRootOffset = 328
+	sbDataBlockSizeOffset     = 336
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// dm_bm_checksum: crc32c with seed ~0 and without final inversion, xor by salt of block type
+func metadataChecksum(data []byte, xor uint32) uint32 {
+	return ^crc32.Checksum(data, crc32c) ^ xor
+}
+
+type binaryMetadataReader struct {
+	reader io.ReaderAt
+}
+
+func (this *binaryMetadataReader) readBlock(blocknr uint64, csumXor uint32) ([]byte, error) {
+	block := make([]byte, metadataBlockSize)
+	_, err := this.reader.ReadAt(block, int64(blocknr)*metadataBlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read metadata block %v: %v", blocknr, err)
+	}
+	if sum := metadataChecksum(block[sbCsumOffset+4:], csumXor); sum != binary.LittleEndian.Uint32(block[sbCsumOffset:]) {
+		return nil, fmt.Errorf("Bad checksum of metadata block %v", blocknr)
+	}
+	if nr := binary.LittleEndian.Uint64(block[sbBlocknrOffset:]); nr != blocknr {
+		return nil, fmt.Errorf("Metadata block %v has wrong blocknr: %v", blocknr, nr)
+	}
+	return block, nil
+}
+
+func (this *binaryMetadataReader) readSuperblock(blocknr uint64) ([]byte, error) {
+	block, err := this.readBlock(blocknr, superblockCsumXor)
+	if err != nil {
+		return nil, err
+	}
+	if magic := binary.LittleEndian.Uint64(block[sbMagicOffset:]); magic != thinSuperblockMagic {
+		return nil, fmt.Errorf("Bad thin superblock magic: %v", magic)
+	}
+	return block, nil
+}
+
+// Walk btree from root and call f for every leaf entry in key order.
+func (this *binaryMetadataReader) walkBtree(root uint64, depth int, f func(key uint64, value []byte) error) error {
+	if depth > btreeMaxDepth {
+		return errors.New("Too deep btree in metadata")
+	}
+	block, err := this.readBlock(root, btreeCsumXor)
+	if err != nil {
+		return err
+	}
+	flags := binary.LittleEndian.Uint32(block[4:])
+	nrEntries := int(binary.LittleEndian.Uint32(block[16:]))
+	maxEntries := int(binary.LittleEndian.Uint32(block[20:]))
+	valueSize := int(binary.LittleEndian.Uint32(block[24:]))
+	if nrEntries > maxEntries || btreeNodeHeaderSize+maxEntries*(8+valueSize) > metadataBlockSize {
+		return fmt.Errorf("Bad btree node %v: entries %v, max entries %v, value size %v", root, nrEntries, maxEntries, valueSize)
+	}
+
+	keys := block[btreeNodeHeaderSize:]
+	values := block[btreeNodeHeaderSize+maxEntries*8:]
+	for i := 0; i < nrEntries; i++ {
+		key := binary.LittleEndian.Uint64(keys[i*8:])
+		value := values[i*valueSize : (i+1)*valueSize]
+		switch {
+		case flags&btreeInternalNode != 0:
+			if valueSize != 8 {
+				return fmt.Errorf("Bad value size of internal btree node %v: %v", root, valueSize)
+			}
+			err = this.walkBtree(binary.LittleEndian.Uint64(value), depth+1, f)
+		case flags&btreeLeafNode != 0:
+			err = f(key, value)
+		default:
+			err = fmt.Errorf("Unknown type of btree node %v: %v", root, flags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Read thin pool metadata in binary on-disk format from metadata device, its copy or image.
+If useMetadataSnap - read metadata snapshot (reserved by 'dmsetup message <pool> 0 reserve_metadata_snap'),
+it is consistent copy of metadata of live pool.
+*/
+func ReadBinaryMetadata(reader io.ReaderAt, useMetadataSnap bool) (*Pool, error) {
+	metadata := binaryMetadataReader{reader: reader}
+	superblock, err := metadata.readSuperblock(0)
+	if err != nil {
+		return nil, err
+	}
+	// Data space map root of held superblock copy is cleared by kernel, so size of data device is read from live
+	// superblock. Roots of mappings and device details are read from held copy.
+	nrDataBlocks := int64(binary.LittleEndian.Uint64(superblock[sbNrDataBlocksOffset:]))
+	if useMetadataSnap {
+		heldRoot := binary.LittleEndian.Uint64(superblock[sbHeldRootOffset:])
+		if heldRoot == 0 {
+			return nil, errors.New("Metadata snapshot isn't reserved")
+		}
+		superblock, err = metadata.readSuperblock(heldRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool := &Pool{
+		UUID:         string(bytes.TrimRight(superblock[sbUUIDOffset:sbUUIDOffset+sbUUIDSize], "\x00")),
+		Time:         int64(binary.LittleEndian.Uint32(superblock[sbTimeOffset:])),
+		Transaction:  int64(binary.LittleEndian.Uint64(superblock[sbTransactionOffset:])),
+		BlockSize:    int64(binary.LittleEndian.Uint32(superblock[sbDataBlockSizeOffset:])) * sectorSize,
+		NrDataBlocks: nrDataBlocks,
+		Devices:      []Device{},
+	}
+	if pool.BlockSize == 0 {
+		return nil, errors.New("Zero data block size in superblock")
+	}
+
+	devices := make(map[int]*Device)
+	getDevice := func(id uint64) *Device {
+		dev := devices[int(id)]
+		if dev == nil {
+			dev = &Device{Id: int(id)}
+			devices[int(id)] = dev
+		}
+		return dev
+	}
+
+	detailsRoot := binary.LittleEndian.Uint64(superblock[sbDeviceDetailsRootOffset:])
+	err = metadata.walkBtree(detailsRoot, 0, func(key uint64, value []byte) error {
+		if len(value) != deviceDetailsSize {
+			return fmt.Errorf("Bad size of device details: %v", len(value))
+		}
+		dev := getDevice(key)
+		dev.MappedBlocks = int64(binary.LittleEndian.Uint64(value[ddMappedBlocksOffset:]))
+		dev.Transaction = int64(binary.LittleEndian.Uint64(value[ddTransactionOffset:]))
+		dev.CreationTime = int64(binary.LittleEndian.Uint32(value[ddCreationTimeOffset:]))
+		dev.SnapTime = int64(binary.LittleEndian.Uint32(value[ddSnapTimeOffset:]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mappingRoot := binary.LittleEndian.Uint64(superblock[sbDataMappingRootOffset:])
+	err = metadata.walkBtree(mappingRoot, 0, func(devId uint64, value []byte) error {
+		if len(value) != 8 {
+			return fmt.Errorf("Bad size of device mapping root: %v", len(value))
+		}
+		dev := getDevice(devId)
+		return metadata.walkBtree(binary.LittleEndian.Uint64(value), 0, func(originBlock uint64, value []byte) error {
+			if len(value) != 8 {
+				return fmt.Errorf("Bad size of block mapping of device %v: %v", devId, len(value))
+			}
+			mapping := binary.LittleEndian.Uint64(value)
+			dev.Blocks = dev.Blocks.appendMerged(Block{
+				OriginOffset: int64(originBlock) * pool.BlockSize,
+				DataOffset:   int64(mapping>>mappingTimeBits) * pool.BlockSize,
+				Length:       pool.BlockSize,
+				Time:         int64(mapping & (1<<mappingTimeBits - 1)),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dev := range devices {
+		pool.Devices = append(pool.Devices, *dev)
+	}
+	sort.Slice(pool.Devices, func(i, j int) bool {
+		return pool.Devices[i].Id < pool.Devices[j].Id
+	})
+	return pool, nil
+}
@@ -0,0 +1,159 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Synthetic writer of dm-thin metadata images
+type metadataImageWriter struct {
+	image []byte
+}
+
+func (this *metadataImageWriter) block(blocknr uint64) []byte {
+	for uint64(len(this.image)) < (blocknr+1)*metadataBlockSize {
+		this.image = append(this.image, make([]byte, metadataBlockSize)...)
+	}
+	return this.image[blocknr*metadataBlockSize : (blocknr+1)*metadataBlockSize]
+}
+
+func (this *metadataImageWriter) seal(blocknr uint64, csumXor uint32) {
+	block := this.block(blocknr)
+	binary.LittleEndian.PutUint64(block[sbBlocknrOffset:], blocknr)
+	binary.LittleEndian.PutUint32(block[sbCsumOffset:], metadataChecksum(block[4:], csumXor))
+}
+
+func (this *metadataImageWriter) writeSuperblock(blocknr uint64, dataBlockSize uint32, mappingRoot, detailsRoot, heldRoot uint64) {
+	block := this.block(blocknr)
+	binary.LittleEndian.PutUint64(block[sbMagicOffset:], thinSuperblockMagic)
+	copy(block[sbUUIDOffset:], "test-uuid")
+	binary.LittleEndian.PutUint32(block[sbTimeOffset:], 4)
+	binary.LittleEndian.PutUint64(block[sbTransactionOffset:], 5)
+	binary.LittleEndian.PutUint64(block[sbNrDataBlocksOffset:], 1000)
+	binary.LittleEndian.PutUint64(block[sbHeldRootOffset:], heldRoot)
+	binary.LittleEndian.PutUint64(block[sbDataMappingRootOffset:], mappingRoot)
+	binary.LittleEndian.PutUint64(block[sbDeviceDetailsRootOffset:], detailsRoot)
+	binary.LittleEndian.PutUint32(block[sbDataBlockSizeOffset:], dataBlockSize)
+	this.seal(blocknr, superblockCsumXor)
+}
+
+func (this *metadataImageWriter) writeNode(blocknr uint64, flags uint32, keys []uint64, values [][]byte, valueSize int) {
+	block := this.block(blocknr)
+	maxEntries := (metadataBlockSize - btreeNodeHeaderSize) / (8 + valueSize)
+	binary.LittleEndian.PutUint32(block[4:], flags)
+	binary.LittleEndian.PutUint32(block[16:], uint32(len(keys)))
+	binary.LittleEndian.PutUint32(block[20:], uint32(maxEntries))
+	binary.LittleEndian.PutUint32(block[24:], uint32(valueSize))
+	for i := range keys {
+		binary.LittleEndian.PutUint64(block[btreeNodeHeaderSize+i*8:], keys[i])
+		copy(block[btreeNodeHeaderSize+maxEntries*8+i*valueSize:], values[i])
+	}
+	this.seal(blocknr, btreeCsumXor)
+}
+
+func le64(v uint64) []byte {
+	res := make([]byte, 8)
+	binary.LittleEndian.PutUint64(res, v)
+	return res
+}
+
+// Leaf of device mapping tree: origin block -> data block
+func (this *metadataImageWriter) writeMappings(blocknr uint64, mappings [][2]uint64, time uint64) {
+	var keys []uint64
+	var values [][]byte
+	for _, m := range mappings {
+		keys = append(keys, m[0])
+		values = append(values, le64(m[1]<<mappingTimeBits|time))
+	}
+	this.writeNode(blocknr, btreeLeafNode, keys, values, 8)
+}
+
+func TestReadBinaryMetadata(t *testing.T) {
+	const blockSize = 128 * sectorSize
+	var w metadataImageWriter
+
+	// Device details: 1, 2, 3
+	details := make([]byte, deviceDetailsSize)
+	binary.LittleEndian.PutUint64(details[ddMappedBlocksOffset:], 6)
+	binary.LittleEndian.PutUint64(details[ddTransactionOffset:], 2)
+	binary.LittleEndian.PutUint32(details[ddCreationTimeOffset:], 1)
+	binary.LittleEndian.PutUint32(details[ddSnapTimeOffset:], 3)
+	w.writeNode(1, btreeLeafNode, []uint64{1, 2, 3}, [][]byte{details, details, details}, deviceDetailsSize)
+
+	// Top level mapping tree: 1, 2. Device 3 without mappings.
+	w.writeNode(2, btreeLeafNode, []uint64{1, 2}, [][]byte{le64(3), le64(6)}, 8)
+
+	// Device 1: internal node with two leafs
+	w.writeNode(3, btreeInternalNode, []uint64{0, 10}, [][]byte{le64(4), le64(5)}, 8)
+	w.writeMappings(4, [][2]uint64{{0, 100}, {1, 101}, {2, 102}, {5, 200}}, 1)
+	w.writeMappings(5, [][2]uint64{{10, 300}, {11, 301}}, 2)
+
+	// Device 2
+	w.writeMappings(6, [][2]uint64{{0, 100}, {1, 50}}, 3)
+
+	// Metadata snapshot: only device 2
+	w.writeNode(7, btreeLeafNode, []uint64{2}, [][]byte{details}, deviceDetailsSize)
+	w.writeNode(8, btreeLeafNode, []uint64{2}, [][]byte{le64(6)}, 8)
+	w.writeSuperblock(9, 128, 8, 7, 0)
+	// Kernel clear space map roots of held superblock copy
+	copy(w.block(9)[sbNrDataBlocksOffset:], make([]byte, 8))
+	w.seal(9, superblockCsumXor)
+
+	w.writeSuperblock(0, 128, 2, 1, 9)
+
+	pool, err := ReadBinaryMetadata(bytes.NewReader(w.image), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Pool{UUID: "test-uuid", Time: 4, Transaction: 5, BlockSize: blockSize, NrDataBlocks: 1000, Devices: []Device{
+		{Id: 1, MappedBlocks: 6, Transaction: 2, CreationTime: 1, SnapTime: 3, Blocks: BlockArr{
+			{OriginOffset: 0, DataOffset: 100 * blockSize, Length: 3 * blockSize, Time: 1},
+			{OriginOffset: 5 * blockSize, DataOffset: 200 * blockSize, Length: blockSize, Time: 1},
+			{OriginOffset: 10 * blockSize, DataOffset: 300 * blockSize, Length: 2 * blockSize, Time: 2},
+		}},
+		{Id: 2, MappedBlocks: 6, Transaction: 2, CreationTime: 1, SnapTime: 3, Blocks: BlockArr{
+			{OriginOffset: 0, DataOffset: 100 * blockSize, Length: blockSize, Time: 3},
+			{OriginOffset: blockSize, DataOffset: 50 * blockSize, Length: blockSize, Time: 3},
+		}},
+		{Id: 3, MappedBlocks: 6, Transaction: 2, CreationTime: 1, SnapTime: 3},
+	}}
+	if !reflect.DeepEqual(pool, expected) {
+		t.Errorf("%#v", pool)
+	}
+
+	pool, err = ReadBinaryMetadata(bytes.NewReader(w.image), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Devices = expected.Devices[1:2]
+	if !reflect.DeepEqual(pool, expected) {
+		t.Errorf("%#v", pool)
+	}
+
+	// Broken checksum
+	broken := append([]byte{}, w.image...)
+	broken[5*metadataBlockSize+100] ^= 1
+	if _, err = ReadBinaryMetadata(bytes.NewReader(broken), false); err == nil {
+		t.Error()
+	}
+
+	// Not thin metadata
+	if _, err = ReadBinaryMetadata(bytes.NewReader(make([]byte, 10*metadataBlockSize)), false); err == nil {
+		t.Error()
+	}
+
+	// No metadata snapshot
+	w.writeSuperblock(0, 128, 2, 1, 0)
+	if _, err = ReadBinaryMetadata(bytes.NewReader(w.image), true); err == nil {
+		t.Error()
+	}
+}
+
+func TestMetadataChecksum(t *testing.T) {
+	// crc32c("123456789") = 0xe3069283, dm_bm_checksum doesn't invert result
+	if sum := metadataChecksum([]byte("123456789"), 0); sum != ^uint32(0xe3069283) {
+		t.Errorf("%x", sum)
+	}
+}
@@ -0,0 +1,146 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+Reader of thin_delta --verbose output. It is Iterator over changes between left and right devices:
+<superblock data_block_size="128" ...>
+
+	<diff left="1" right="2">
+	  <same><range begin="0" data_begin="10" length="5"/></same>
+	  <different><range begin="5" left_data_begin="20" right_data_begin="30" length="2"/></different>
+	  <left_only><range begin="7" data_begin="40" length="1"/></left_only>
+	  <right_only><range begin="8" data_begin="50" length="3"/></right_only>
+	</diff>
+
+</superblock>
+Ranges are in data blocks. Output without --verbose (<different begin="" length=""/>) hasn't data location, so
+changed data can't be readed by it.
+*/
+type ThinDeltaReader struct {
+	BlockSize int64 // data block size, bytes
+	Left      int   // DevID of old device
+	Right     int   // DevID of new device
+
+	xmlReader *xml.Decoder
+	section   string // current section: same, different, left_only, right_only
+}
+
+// Read thin_delta output to start of diff
+func NewThinDeltaReader(reader io.Reader) (*ThinDeltaReader, error) {
+	res := &ThinDeltaReader{xmlReader: xml.NewDecoder(reader)}
+	for {
+		token, err := res.xmlReader.Token()
+		if err != nil {
+			return nil, errors.New("Parse token error: " + err.Error())
+		}
+		t, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch t.Name.Local {
+		case "superblock":
+			res.BlockSize, err = strconv.ParseInt(getAttr(t.Attr, "data_block_size"), 10, 64)
+			if err != nil {
+				return nil, errors.New("Can't parse blockSize: " + err.Error())
+			}
+			res.BlockSize *= sectorSize
+		case "diff":
+			if res.BlockSize == 0 {
+				return nil, errors.New("diff before superblock")
+			}
+			res.Left, err = strconv.Atoi(getAttr(t.Attr, "left"))
+			if err != nil {
+				return nil, errors.New("Can't parse left device id: " + getAttr(t.Attr, "left"))
+			}
+			res.Right, err = strconv.Atoi(getAttr(t.Attr, "right"))
+			if err != nil {
+				return nil, errors.New("Can't parse right device id: " + getAttr(t.Attr, "right"))
+			}
+			return res, nil
+		}
+	}
+}
+
+func (this *ThinDeltaReader) Next(ctx context.Context) (change Change, ok bool, err error) {
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		token, err := this.xmlReader.Token()
+		if err != nil {
+			return change, false, errors.New("Parse token error: " + err.Error())
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "same", "different", "left_only", "right_only":
+				if getAttr(t.Attr, "begin") != "" {
+					return change, false, errors.New("Range without data location, thin_delta must be called with --verbose")
+				}
+				this.section = t.Name.Local
+			case "range":
+				change, err = this.parseRange(t)
+				return change, err == nil, err
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "same", "different", "left_only", "right_only":
+				this.section = ""
+			case "diff":
+				return change, false, nil
+			}
+		}
+	}
+}
+
+func (this *ThinDeltaReader) parseRange(t xml.StartElement) (change Change, err error) {
+	parse := func(name string) int64 {
+		if err != nil {
+			return 0
+		}
+		var res int64
+		res, err = strconv.ParseInt(getAttr(t.Attr, name), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Can't parse range %v '%v': %v", name, getAttr(t.Attr, name), err)
+		}
+		return res * this.BlockSize
+	}
+	origin := parse("begin")
+	length := parse("length")
+
+	switch this.section {
+	case "same":
+		block := Block{OriginOffset: origin, DataOffset: parse("data_begin"), Length: length}
+		change = Change{Patch: Patch{Operation: NONE}, From: BlockArr{block}, To: BlockArr{block}}
+	case "different":
+		change = Change{
+			Patch: Patch{Operation: WRITE, Offset: origin, Length: length},
+			From:  BlockArr{{OriginOffset: origin, DataOffset: parse("left_data_begin"), Length: length}},
+			To:    BlockArr{{OriginOffset: origin, DataOffset: parse("right_data_begin"), Length: length}},
+		}
+	case "left_only":
+		change = Change{
+			Patch: Patch{Operation: DELETE, Offset: origin, Length: length},
+			From:  BlockArr{{OriginOffset: origin, DataOffset: parse("data_begin"), Length: length}},
+		}
+	case "right_only":
+		change = Change{
+			Patch: Patch{Operation: WRITE, Offset: origin, Length: length},
+			To:    BlockArr{{OriginOffset: origin, DataOffset: parse("data_begin"), Length: length}},
+		}
+	default:
+		return change, errors.New("range outside of same, different, left_only or right_only")
+	}
+	if err == nil && length <= 0 {
+		err = fmt.Errorf("Bad range length: %v", length)
+	}
+	return change, err
+}
@@ -0,0 +1,72 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestThinDeltaReader(t *testing.T) {
+	data := `<superblock uuid="" time="5" transaction="17" data_block_size="128" nr_data_blocks="1000">
+  <diff left="1" right="2">
+    <same>
+      <range begin="0" data_begin="10" length="5"/>
+    </same>
+    <different>
+      <range begin="5" left_data_begin="20" right_data_begin="30" length="2"/>
+    </different>
+    <left_only>
+      <range begin="7" data_begin="40" length="1"/>
+    </left_only>
+    <right_only>
+      <range begin="8" data_begin="50" length="3"/>
+      <range begin="20" data_begin="60" length="1"/>
+    </right_only>
+  </diff>
+</superblock>
+`
+	const blockSize = 128 * 512
+
+	reader, err := NewThinDeltaReader(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.BlockSize != blockSize || reader.Left != 1 || reader.Right != 2 {
+		t.Errorf("%#v", reader)
+	}
+
+	same := Block{OriginOffset: 0, DataOffset: 10 * blockSize, Length: 5 * blockSize}
+	expected := []Change{
+		{Patch: Patch{Operation: NONE}, From: BlockArr{same}, To: BlockArr{same}},
+		{Patch: Patch{Operation: WRITE, Offset: 5 * blockSize, Length: 2 * blockSize},
+			From: BlockArr{{OriginOffset: 5 * blockSize, DataOffset: 20 * blockSize, Length: 2 * blockSize}},
+			To:   BlockArr{{OriginOffset: 5 * blockSize, DataOffset: 30 * blockSize, Length: 2 * blockSize}}},
+		{Patch: Patch{Operation: DELETE, Offset: 7 * blockSize, Length: blockSize},
+			From: BlockArr{{OriginOffset: 7 * blockSize, DataOffset: 40 * blockSize, Length: blockSize}}},
+		{Patch: Patch{Operation: WRITE, Offset: 8 * blockSize, Length: 3 * blockSize},
+			To: BlockArr{{OriginOffset: 8 * blockSize, DataOffset: 50 * blockSize, Length: 3 * blockSize}}},
+		{Patch: Patch{Operation: WRITE, Offset: 20 * blockSize, Length: blockSize},
+			To: BlockArr{{OriginOffset: 20 * blockSize, DataOffset: 60 * blockSize, Length: blockSize}}},
+	}
+	res := readAllChanges(t, reader)
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("%#v", res)
+	}
+}
+
+func TestThinDeltaReaderNotVerbose(t *testing.T) {
+	data := `<superblock uuid="" time="5" transaction="17" data_block_size="128" nr_data_blocks="1000">
+  <diff left="1" right="2">
+    <different begin="5" length="2"/>
+  </diff>
+</superblock>
+`
+	reader, err := NewThinDeltaReader(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = reader.Next(context.Background()); err == nil {
+		t.Error()
+	}
+}
@@ -42,10 +42,19 @@ func TestParser(t *testing.T){
 		t.Error(err)
 	}
 
-	if len(res) != 2 {
-		t.Error()
+	if res.BlockSize != blockSize {
+		t.Error(res.BlockSize)
+	}
+	if res.UUID != "" || res.Time != 5 || res.Transaction != 17 || res.NrDataBlocks != 0 {
+		t.Errorf("%#v", res)
+	}
+	if len(res.Devices) != 2 {
+		t.Fatal()
+	}
+	if d := res.Devices[1]; d.MappedBlocks != 40960001 || d.Transaction != 1 || d.CreationTime != 1 || d.SnapTime != 1 {
+		t.Errorf("%#v", d)
 	}
-	dev := res[0]
+	dev := res.Devices[0]
 	if dev.Id != 1 {
 		t.Error()
 	}
@@ -54,28 +63,28 @@ func TestParser(t *testing.T){
 		t.Error()
 	}
 
-	b := dataBlock{OriginOffset:0, DataOffset:0, Length: blockSize}
+	b := Block{OriginOffset:0, DataOffset:0, Length: blockSize}
 	if dev.Blocks[0] != b {
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:8190976*blockSize, DataOffset:8461326*blockSize, Length: 80*blockSize}
+	b = Block{OriginOffset:8190976*blockSize, DataOffset:8461326*blockSize, Length: 80*blockSize, Time: 5}
 	if dev.Blocks[1] != b {
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:8191056*blockSize, DataOffset:8461529*blockSize, Length:9*blockSize}
+	b = Block{OriginOffset:8191056*blockSize, DataOffset:8461529*blockSize, Length:9*blockSize, Time: 5}
 	if dev.Blocks[2] != b {
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:8191999*blockSize, DataOffset:4146006*blockSize, Length:blockSize}
+	b = Block{OriginOffset:8191999*blockSize, DataOffset:4146006*blockSize, Length:blockSize, Time: 5}
 	if dev.Blocks[3] != b {
 		t.Error()
 	}
 
 	// DEV2
-	dev = res[1]
+	dev = res.Devices[1]
 	if dev.Id != 2 {
 		t.Error()
 	}
@@ -84,17 +93,17 @@ func TestParser(t *testing.T){
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:1*blockSize, DataOffset:1*blockSize, Length: blockSize}
+	b = Block{OriginOffset:1*blockSize, DataOffset:1*blockSize, Length: blockSize, Time: 1}
 	if dev.Blocks[0] != b {
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:81909761*blockSize, DataOffset:84613261*blockSize, Length: 801*blockSize}
+	b = Block{OriginOffset:81909761*blockSize, DataOffset:84613261*blockSize, Length: 801*blockSize, Time: 53}
 	if dev.Blocks[1] != b {
 		t.Error()
 	}
 
-	b = dataBlock{OriginOffset:81910561*blockSize, DataOffset:84615291*blockSize, Length:91*blockSize}
+	b = Block{OriginOffset:81910561*blockSize, DataOffset:84615291*blockSize, Length:91*blockSize, Time: 52}
 	if dev.Blocks[2] != b {
 		t.Error()
 	}
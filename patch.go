@@ -0,0 +1,483 @@
+package lvm_thin_diff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	patchMagic      = "LVM-THIN-DIFF"
+	patchVersion    = 7
+	patchMinVersion = 2 // oldest version, which can be readed
+)
+
+/*
+Patch stream format (gob):
+patchHeader
+patchRecord records. WRITE record followed by patchChunk values with total data length equal to record Length.
+ZERO record hasn't data. NONE records are written before version 6 only, they are skipped by readers.
+patchRecord{Operation: END}
+patchSummary, since version 6
+patchTrailer
+*/
+
+// First record of patch stream. Describe what patch contains and to which device it can be applied.
+type patchHeader struct {
+	Magic     string
+	Version   int
+	BlockSize int64  // data block size of thin pool, bytes
+	FromDevId int    // DevID of base snapshot
+	ToDevId   int    // DevID of snapshot, which will be got after apply patch
+	Size      int64  // origin device size, bytes. Patch can't be applied to smaller device.
+	Codec     string // name of codec for data chunks, empty for uncompressed data. Since version 3.
+
+	// Encryption of data chunks, empty for unencrypted patch. Since version 4.
+	Encryption    string
+	NonceScheme   string
+	NoncePrefix   []byte
+	KeyId         string // id of encryption key, for detect wrong key before decrypt
+	KdfSalt       []byte // PBKDF2 salt, if key is passphrase
+	KdfIterations int    // PBKDF2 iterations, 0 for raw key
+	SubkeySalt    []byte // HKDF salt of patch subkeys. Since version 7.
+}
+
+// Data buffer of WRITE operation
+type patchChunk struct {
+	Data   []byte            // data, compressed by codec and encrypted, if it set in header
+	Sum    [sha256.Size]byte // sha256 of Data
+	Length int64             // length of decoded data. Since version 4.
+}
+
+// Record of patch stream, it decoded to Patch
+type patchRecord struct {
+	Operation int
+	Offset    int64
+	Length    int64
+	Check     []byte // checksum of record, see recordCheck. Since version 7.
+}
+
+// Summary of patch after END record. Unchanged ranges aren't written as records, they summarized here.
+type patchSummary struct {
+	SharedExtents int64   // count of contiguous origin ranges, which unchanged and shared by from and to devices
+	SharedBytes   int64   // total length of shared ranges
+	Shared        []Patch // shared ranges as NONE records, if writer saved them
+}
+
+// Last record of patch stream
+type patchTrailer struct {
+	Sum       [sha256.Size]byte // sha256 of all stream bytes before trailer, include END record.
+	Signature []byte            // Ed25519 signature of Sum, empty for unsigned patch
+	MAC       []byte            // HMAC-SHA256 of Sum by MAC subkey of encrypted patch. Since version 7.
+}
+
+func newPatchHeader(blockSize int64, fromDevId, toDevId int, size int64) patchHeader {
+	return patchHeader{
+		Magic:     patchMagic,
+		Version:   patchVersion,
+		BlockSize: blockSize,
+		FromDevId: fromDevId,
+		ToDevId:   toDevId,
+		Size:      size,
+	}
+}
+
+// Check if patch can be applied to target device, which contains snapshot fromDevId and has targetSize bytes.
+func (this *patchHeader) checkTarget(fromDevId int, targetSize int64) error {
+	if this.FromDevId != fromDevId {
+		return &PatchError{Err: fmt.Errorf("Patch created from snapshot %v, but target contains snapshot %v", this.FromDevId, fromDevId)}
+	}
+	if targetSize < this.Size {
+		return &PatchError{Err: fmt.Errorf("Target too small for patch: %v bytes, need %v", targetSize, this.Size)}
+	}
+	return nil
+}
+
+type patchWriter struct {
+	enc        *gob.Encoder
+	hash       hash.Hash
+	codec      Codec
+	cipher     *chunkCipher
+	dataOffset int64              // origin offset of next data chunk
+	signKey    ed25519.PrivateKey // sign patch by the key, if not nil
+	version    int                // version of patch header: summary is written since version 6, record checks since 7
+	summary    patchSummary
+	saveShared bool // save shared ranges to summary
+}
+
+// Write patch header. If key isn't nil - data chunks will be encrypted by it.
+func newPatchWriter(writer io.Writer, header patchHeader, key *Key) (*patchWriter, error) {
+	var res patchWriter
+	var err error
+	res.codec, err = getCodec(header.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		res.cipher, err = key.newHeaderCipher(&header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.version = header.Version
+	res.hash = sha256.New()
+	res.enc = gob.NewEncoder(io.MultiWriter(writer, res.hash))
+	err = res.enc.Encode(header)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (this *patchWriter) WritePatch(patch Patch) error {
+	this.dataOffset = patch.Offset
+	return this.writeRecord(patch)
+}
+
+func (this *patchWriter) writeRecord(patch Patch) error {
+	record := patchRecord{Operation: patch.Operation, Offset: patch.Offset, Length: patch.Length}
+	if this.version >= 7 {
+		record.Check = recordCheck(checkHash(this.cipher), this.hash.Sum(nil), patch)
+	}
+	return this.enc.Encode(record)
+}
+
+// Hash for record checks and trailer MAC: HMAC by MAC subkey of encrypted patch, else sha256
+func checkHash(cipher *chunkCipher) hash.Hash {
+	if cipher != nil {
+		return cipher.newMAC()
+	}
+	return sha256.New()
+}
+
+// Checksum of record: h of stream digest before the record and fields of the record. Reader check record before
+// apply it, digest bind record to its place in stream.
+func recordCheck(h hash.Hash, digest []byte, patch Patch) []byte {
+	h.Write(digest)
+	binary.Write(h, binary.BigEndian, [3]int64{int64(patch.Operation), patch.Offset, patch.Length})
+	return h.Sum(nil)
+}
+
+// Write data chunk of last WRITE record
+func (this *patchWriter) WriteData(buf []byte) error {
+	length := int64(len(buf))
+	if this.codec != nil {
+		var err error
+		buf, err = this.codec.Encode(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if this.cipher != nil {
+		buf = this.cipher.Seal(this.dataOffset, buf)
+	}
+	this.dataOffset += length
+	return this.enc.Encode(patchChunk{Data: buf, Sum: sha256.Sum256(buf), Length: length})
+}
+
+// Add shared blocks to summary instead of NONE record. Blocks must be added in origin order.
+func (this *patchWriter) AddShared(blocks BlockArr) {
+	this.summary.add(blocks, this.saveShared)
+}
+
+// Add shared blocks to summary, contiguous blocks are counted as one range. If saveRanges is false - only last range
+// is kept for merge next blocks.
+func (this *patchSummary) add(blocks BlockArr, saveRanges bool) {
+	for _, block := range blocks {
+		if block.Length == 0 {
+			continue
+		}
+		this.SharedBytes += block.Length
+		shared := this.Shared
+		if n := len(shared); n > 0 && shared[n-1].Offset+shared[n-1].Length == block.OriginOffset {
+			shared[n-1].Length += block.Length
+			continue
+		}
+		this.SharedExtents++
+		this.Shared = append(shared, Patch{Operation: NONE, Offset: block.OriginOffset, Length: block.Length})
+		if !saveRanges {
+			this.Shared = this.Shared[len(this.Shared)-1:]
+		}
+	}
+}
+
+// Write END record, summary and trailer. Doesn't close underlying writer.
+func (this *patchWriter) Close() error {
+	err := this.writeRecord(Patch{Operation: END})
+	if err != nil {
+		return err
+	}
+	if this.version >= 6 {
+		if !this.saveShared {
+			this.summary.Shared = nil
+		}
+		err = this.enc.Encode(this.summary)
+		if err != nil {
+			return err
+		}
+	}
+	var trailer patchTrailer
+	copy(trailer.Sum[:], this.hash.Sum(nil))
+	if this.signKey != nil {
+		trailer.Signature = signPatchSum(this.signKey, trailer.Sum)
+	}
+	if this.cipher != nil {
+		trailer.MAC = trailerMAC(this.cipher, trailer.Sum)
+	}
+	return this.enc.Encode(trailer)
+}
+
+func trailerMAC(cipher *chunkCipher, sum [sha256.Size]byte) []byte {
+	mac := cipher.newMAC()
+	mac.Write(sum[:])
+	return mac.Sum(nil)
+}
+
+// Reader feed hash by all readed bytes. gob.Decoder read exactly message bytes from io.ByteReader, so hash contains
+// stream exactly to last decoded value.
+type hashReader struct {
+	reader *bufio.Reader
+	hash   hash.Hash
+}
+
+func (this *hashReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.hash.Write(p[:n])
+	return n, err
+}
+
+func (this *hashReader) ReadByte() (byte, error) {
+	b, err := this.reader.ReadByte()
+	if err == nil {
+		this.hash.Write([]byte{b})
+	}
+	return b, err
+}
+
+type patchReader struct {
+	Header  patchHeader
+	Summary patchSummary // filled after END record, empty before version 6
+	Trailer patchTrailer // filled after END record
+	dec     *gob.Decoder
+	hash    hash.Hash
+	codec   Codec
+	cipher  *chunkCipher
+	end     bool
+}
+
+// Read and check patch header. key is needed for read data of encrypted patch.
+func newPatchReader(reader io.Reader, key *Key) (*patchReader, error) {
+	var res patchReader
+	res.hash = sha256.New()
+	res.dec = gob.NewDecoder(&hashReader{reader: bufio.NewReader(reader), hash: res.hash})
+	err := res.dec.Decode(&res.Header)
+	if err != nil {
+		return nil, &PatchError{Err: errors.New("Can't read patch header: " + err.Error())}
+	}
+	res.codec, res.cipher, err = res.Header.open(key)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Check magic and version of header, return codec and cipher for data chunks. Cipher is nil if key is nil.
+func (this *patchHeader) open(key *Key) (codec Codec, cipher *chunkCipher, err error) {
+	if this.Magic != patchMagic {
+		return nil, nil, &PatchError{Err: fmt.Errorf("Bad patch magic: %q", this.Magic)}
+	}
+	if this.Version < patchMinVersion || this.Version > patchVersion {
+		return nil, nil, &PatchError{Err: fmt.Errorf("Unsupported patch version: %v", this.Version)}
+	}
+	codec, err = getCodec(this.Codec)
+	if err != nil {
+		return nil, nil, &PatchError{Err: err}
+	}
+	if key != nil {
+		if this.Encryption == "" {
+			return nil, nil, &PatchError{Err: errors.New("Patch isn't encrypted, but key is set")}
+		}
+		cipher, err = key.headerCipher(this)
+		if err != nil {
+			return nil, nil, &PatchError{Err: err}
+		}
+	}
+	return codec, cipher, nil
+}
+
+// Return next record of patch. NONE records of old patches are skipped and counted in Summary.
+// After END record read and check summary and trailer, then return io.EOF.
+func (this *patchReader) Next() (patch Patch, err error) {
+	if this.end {
+		return patch, io.EOF
+	}
+	for {
+		digest := this.hash.Sum(nil)
+		var record patchRecord
+		err = this.dec.Decode(&record)
+		if err == io.EOF {
+			return patch, &PatchError{Err: errors.New("Unexpected end of patch, it may be truncated")}
+		}
+		if err != nil {
+			return patch, &PatchError{Err: errors.New("Can't read patch record: " + err.Error())}
+		}
+		patch = Patch{Operation: record.Operation, Offset: record.Offset, Length: record.Length}
+		// Records of encrypted patch can be checked with key only
+		checked := this.Header.Version >= 7 && (this.Header.Encryption == "" || this.cipher != nil)
+		if checked && !hmac.Equal(record.Check, recordCheck(checkHash(this.cipher), digest, patch)) {
+			return Patch{}, &PatchError{Err: fmt.Errorf("Record checksum mismatch at offset %v", patch.Offset)}
+		}
+		if patch.Operation != NONE {
+			break
+		}
+		this.Summary.SharedExtents++
+	}
+	if patch.Operation != END {
+		if patch.Offset < 0 || patch.Length <= 0 || patch.Length > this.Header.Size-patch.Offset {
+			return Patch{}, &PatchError{Err: fmt.Errorf("Bad patch record: offset %v, length %v, device size %v", patch.Offset, patch.Length, this.Header.Size)}
+		}
+		return patch, nil
+	}
+
+	this.end = true
+	if this.Header.Version >= 6 {
+		err = this.dec.Decode(&this.Summary)
+		if err != nil {
+			return patch, &PatchError{Err: errors.New("Can't read patch summary: " + err.Error())}
+		}
+	}
+	sum := this.hash.Sum(nil)
+	err = this.dec.Decode(&this.Trailer)
+	if err != nil {
+		return patch, &PatchError{Err: errors.New("Can't read patch trailer: " + err.Error())}
+	}
+	if !bytes.Equal(sum, this.Trailer.Sum[:]) {
+		return patch, &PatchError{Err: fmt.Errorf("Patch checksum mismatch: %x != %x", sum, this.Trailer.Sum)}
+	}
+	if this.cipher != nil && !hmac.Equal(this.Trailer.MAC, trailerMAC(this.cipher, this.Trailer.Sum)) {
+		return patch, &PatchError{Err: errors.New("Patch authentication failed, it may be changed without key")}
+	}
+	return patch, io.EOF
+}
+
+// Read data of WRITE record by buffers. Call f for every buffer with origin offset of the buffer.
+func (this *patchReader) ReadData(patch Patch, f func(offset int64, buf []byte) error) error {
+	if this.Header.Encryption != "" && this.cipher == nil {
+		return &PatchError{Err: errors.New("Patch is encrypted, key is needed for read data")}
+	}
+	return this.readData(patch, true, f)
+}
+
+// Read data of WRITE record and check checksums, but doesn't decrypt and decompress it. f get raw chunk data.
+func (this *patchReader) ReadRawData(patch Patch, f func(offset int64, buf []byte) error) error {
+	if this.Header.Version < 4 && this.Header.Codec != "" {
+		return &PatchError{Err: errors.New("Can't read raw compressed data of patch before version 4")}
+	}
+	return this.readData(patch, false, f)
+}
+
+func (this *patchReader) readData(patch Patch, decode bool, f func(offset int64, buf []byte) error) error {
+	var readedBytes int64
+	for readedBytes < patch.Length {
+		offset := patch.Offset + readedBytes
+		var chunk patchChunk
+		err := this.dec.Decode(&chunk)
+		if err != nil {
+			return &PatchError{Err: fmt.Errorf("Can't read data for offset %v: %v", offset, err)}
+		}
+		if sha256.Sum256(chunk.Data) != chunk.Sum {
+			return &PatchError{Err: fmt.Errorf("Data checksum mismatch at offset %v", offset)}
+		}
+		length := chunk.Length
+		if this.Header.Version < 4 {
+			length = int64(len(chunk.Data))
+		}
+		if decode {
+			if this.cipher != nil {
+				chunk.Data, err = this.cipher.Open(offset, chunk.Data)
+				if err != nil {
+					return &PatchError{Err: fmt.Errorf("Can't decrypt data for offset %v: %v", offset, err)}
+				}
+			}
+			if this.codec != nil {
+				// Decoded length isn't stored before version 4
+				maxLength := patch.Length - readedBytes
+				if this.Header.Version >= 4 {
+					maxLength = minInt64(maxLength, chunk.Length)
+				}
+				chunk.Data, err = this.codec.Decode(chunk.Data, maxLength)
+				if err != nil {
+					return &PatchError{Err: fmt.Errorf("Can't decode data for offset %v: %v", offset, err)}
+				}
+			}
+			if this.Header.Version < 4 {
+				length = int64(len(chunk.Data))
+			}
+			if int64(len(chunk.Data)) != length {
+				return &PatchError{Err: fmt.Errorf("Data length mismatch at offset %v", offset)}
+			}
+		}
+		if length <= 0 || readedBytes+length > patch.Length {
+			return &PatchError{Err: fmt.Errorf("Data buffer overrun patch record at offset %v", patch.Offset)}
+		}
+		err = f(offset, chunk.Data)
+		if err != nil {
+			return err
+		}
+		readedBytes += length
+	}
+	return nil
+}
+
+type VerifyOptions struct {
+	Key         *Key                // key for decrypt data of encrypted patch. If nil - only checksums of encrypted data checked.
+	TrustedKeys []ed25519.PublicKey // if not empty - patch must be signed by one of the keys
+}
+
+// Read full patch and check it integrity without apply.
+func VerifyPatch(ctx context.Context, reader io.Reader, opts VerifyOptions) error {
+	patchReader, err := newPatchReader(reader, opts.Key)
+	if err != nil {
+		return err
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		patch, err := patchReader.Next()
+		if err == io.EOF {
+			if len(opts.TrustedKeys) > 0 {
+				return checkPatchSignature(patchReader.Trailer, opts.TrustedKeys)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch patch.Operation {
+		case NONE, DELETE, ZERO:
+			// pass
+		case WRITE:
+			skip := func(int64, []byte) error { return nil }
+			if patchReader.Header.Encryption != "" && opts.Key == nil {
+				err = patchReader.ReadRawData(patch, skip)
+			} else {
+				err = patchReader.ReadData(patch, skip)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return &PatchError{Err: fmt.Errorf("Unknown patch operation: %v", patch.Operation)}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPatchHeader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	header := newPatchHeader(65536, 1, 2, 1024*1024)
+	gob.NewEncoder(buf).Encode(header)
+	r, err := newPatchReader(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Header, header) {
+		t.Errorf("%#v != %#v", r.Header, header)
+	}
+
+	// Bad magic
+	buf.Reset()
+	header.Magic = "TEST"
+	gob.NewEncoder(buf).Encode(header)
+	_, err = newPatchReader(buf, nil)
+	if err == nil {
+		t.Error()
+	}
+
+	// Bad version
+	buf.Reset()
+	header = newPatchHeader(65536, 1, 2, 1024*1024)
+	header.Version = patchVersion + 1
+	gob.NewEncoder(buf).Encode(header)
+	_, err = newPatchReader(buf, nil)
+	if err == nil {
+		t.Error()
+	}
+
+	// Old version
+	buf.Reset()
+	header = newPatchHeader(65536, 1, 2, 1024*1024)
+	header.Version = 2
+	gob.NewEncoder(buf).Encode(header)
+	_, err = newPatchReader(buf, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Unknown codec
+	buf.Reset()
+	header = newPatchHeader(65536, 1, 2, 1024*1024)
+	header.Codec = "test"
+	gob.NewEncoder(buf).Encode(header)
+	_, err = newPatchReader(buf, nil)
+	if err == nil {
+		t.Error()
+	}
+
+	// Stream without header
+	buf.Reset()
+	gob.NewEncoder(buf).Encode(Patch{Operation: WRITE, Offset: 1, Length: 2})
+	_, err = newPatchReader(buf, nil)
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestPatchHeaderCheckTarget(t *testing.T) {
+	header := newPatchHeader(65536, 1, 2, 1024)
+	if err := header.checkTarget(1, 1024); err != nil {
+		t.Error(err)
+	}
+	if err := header.checkTarget(1, 2048); err != nil {
+		t.Error(err)
+	}
+	if header.checkTarget(2, 1024) == nil {
+		t.Error()
+	}
+	if header.checkTarget(1, 1023) == nil {
+		t.Error()
+	}
+}
+
+func TestVerifyPatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, _ := newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+	w.WritePatch(Patch{Operation: WRITE, Offset: 10, Length: 10})
+	w.WriteData([]byte("0123456789"))
+	w.WritePatch(Patch{Operation: DELETE, Offset: 20, Length: 10})
+	w.Close()
+	data := buf.Bytes()
+
+	if err := VerifyPatch(context.Background(), bytes.NewReader(data), VerifyOptions{}); err != nil {
+		t.Error(err)
+	}
+
+	// Truncated
+	for _, size := range []int{len(data) - 1, len(data) / 2} {
+		if VerifyPatch(context.Background(), bytes.NewReader(data[:size]), VerifyOptions{}) == nil {
+			t.Error(size)
+		}
+	}
+
+	// Bit flip in data
+	broken := append([]byte{}, data...)
+	pos := bytes.Index(broken, []byte("0123456789"))
+	broken[pos+5] ^= 1
+	if VerifyPatch(context.Background(), bytes.NewReader(broken), VerifyOptions{}) == nil {
+		t.Error()
+	}
+
+	// Change record, keep trailer
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+	w.WritePatch(Patch{Operation: DELETE, Offset: 20, Length: 10})
+	w.Close()
+	broken = append([]byte{}, buf.Bytes()...)
+	buf.Reset()
+	w, _ = newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+	w.WritePatch(Patch{Operation: DELETE, Offset: 21, Length: 10})
+	w.Close()
+	for i := range broken {
+		if broken[i] != buf.Bytes()[i] {
+			broken[i] = buf.Bytes()[i]
+			break
+		}
+	}
+	if VerifyPatch(context.Background(), bytes.NewReader(broken), VerifyOptions{}) == nil {
+		t.Error()
+	}
+}
+
+func TestPatchSummary(t *testing.T) {
+	readAll := func(data []byte) ([]Patch, patchSummary) {
+		r, err := newPatchReader(bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []Patch
+		for {
+			patch, err := r.Next()
+			if err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				return records, r.Summary
+			}
+			records = append(records, patch)
+		}
+	}
+	expectedRecords := []Patch{{Operation: DELETE, Offset: 20, Length: 10}}
+
+	// Shared ranges are saved to summary only
+	for _, saveShared := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		w, _ := newPatchWriter(buf, newPatchHeader(1, 1, 2, 100), nil)
+		w.saveShared = saveShared
+		w.AddShared(BlockArr{{OriginOffset: 0, Length: 5}, {OriginOffset: 5, Length: 5}})
+		w.AddShared(BlockArr{{OriginOffset: 10, Length: 10}})
+		w.WritePatch(Patch{Operation: DELETE, Offset: 20, Length: 10})
+		w.AddShared(BlockArr{{OriginOffset: 30, Length: 10}})
+		w.Close()
+
+		records, summary := readAll(buf.Bytes())
+		if !reflect.DeepEqual(records, expectedRecords) {
+			t.Errorf("%#v", records)
+		}
+		expectedSummary := patchSummary{SharedExtents: 2, SharedBytes: 30}
+		if saveShared {
+			expectedSummary.Shared = []Patch{{Operation: NONE, Offset: 0, Length: 20}, {Operation: NONE, Offset: 30, Length: 10}}
+		}
+		if !reflect.DeepEqual(summary, expectedSummary) {
+			t.Errorf("%v %#v", saveShared, summary)
+		}
+	}
+
+	// Old patch with NONE records and without summary
+	buf := &bytes.Buffer{}
+	header := newPatchHeader(1, 1, 2, 100)
+	header.Version = 5
+	w, _ := newPatchWriter(buf, header, nil)
+	w.WritePatch(Patch{Operation: NONE})
+	w.WritePatch(Patch{Operation: DELETE, Offset: 20, Length: 10})
+	w.WritePatch(Patch{Operation: NONE})
+	w.Close()
+	records, summary := readAll(buf.Bytes())
+	if !reflect.DeepEqual(records, expectedRecords) {
+		t.Errorf("%#v", records)
+	}
+	if !reflect.DeepEqual(summary, patchSummary{SharedExtents: 2}) {
+		t.Errorf("%#v", summary)
+	}
+}
@@ -0,0 +1,40 @@
+package lvm_thin_diff
+
+import (
+	"context"
+)
+
+// Estimation of patch by metadata only
+type DiffPlan struct {
+	WriteExtents  int64 `json:"write_extents"`
+	WriteBytes    int64 `json:"write_bytes"` // upper bound of patch data: compression, ZERO records and content compare reduce it
+	DeleteExtents int64 `json:"delete_extents"`
+	DeleteBytes   int64 `json:"delete_bytes"`
+	SharedBytes   int64 `json:"shared_bytes"` // bytes, which mapped to same data in both devices and unchanged
+}
+
+// Count changes of iter without read data. Use it with Coalesce for get count of patch records.
+func PlanDiff(ctx context.Context, iter Iterator) (*DiffPlan, error) {
+	var plan DiffPlan
+	for {
+		change, ok, err := iter.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return &plan, nil
+		}
+		switch change.Operation {
+		case WRITE:
+			plan.WriteExtents++
+			plan.WriteBytes += change.Length
+		case DELETE:
+			plan.DeleteExtents++
+			plan.DeleteBytes += change.Length
+		case NONE:
+			for _, block := range change.To {
+				plan.SharedBytes += block.Length
+			}
+		}
+	}
+}
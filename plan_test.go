@@ -0,0 +1,29 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPlanDiff(t *testing.T) {
+	from := &Device{Id: 1, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 100},
+		{OriginOffset: 200, DataOffset: 100, Length: 100},
+		{OriginOffset: 400, DataOffset: 200, Length: 50},
+	}}
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 50},
+		{OriginOffset: 50, DataOffset: 500, Length: 100},
+		{OriginOffset: 400, DataOffset: 200, Length: 50},
+		{OriginOffset: 450, DataOffset: 700, Length: 50},
+	}}
+	plan, err := PlanDiff(context.Background(), Coalesce(Diff(from, to)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &DiffPlan{WriteExtents: 2, WriteBytes: 150, DeleteExtents: 1, DeleteBytes: 100, SharedBytes: 100}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("%#v", plan)
+	}
+}
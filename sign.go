@@ -0,0 +1,85 @@
+package lvm_thin_diff
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Signed message is the prefix and sha256 of patch stream
+const signaturePrefix = "lvm-thin-diff patch signature v1\x00"
+
+func signPatchSum(key ed25519.PrivateKey, sum [sha256.Size]byte) []byte {
+	return ed25519.Sign(key, append([]byte(signaturePrefix), sum[:]...))
+}
+
+// Check if patch with trailer signed by one of trusted keys
+func checkPatchSignature(trailer patchTrailer, trustedKeys []ed25519.PublicKey) error {
+	if len(trailer.Signature) == 0 {
+		return &PatchError{Err: errors.New("Patch isn't signed")}
+	}
+	message := append([]byte(signaturePrefix), trailer.Sum[:]...)
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, message, trailer.Signature) {
+			return nil
+		}
+	}
+	return &PatchError{Err: errors.New("Patch isn't signed by trusted key")}
+}
+
+// Read Ed25519 private key from PEM file in PKCS #8 format, as openssl genpkey -algorithm ed25519
+func LoadSignKeyFile(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("Can't find PRIVATE KEY PEM block in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Key isn't Ed25519 key: %T", key)
+	}
+	return res, nil
+}
+
+// Read Ed25519 public keys from PEM file with PUBLIC KEY blocks in PKIX format, as openssl pkey -pubout
+func LoadTrustedKeysFile(path string) ([]ed25519.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Key isn't Ed25519 key: %T", key)
+		}
+		res = append(res, edKey)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("No PUBLIC KEY PEM blocks in " + path)
+	}
+	return res, nil
+}
@@ -0,0 +1,83 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSignKeys(t *testing.T) {
+	dir := t.TempDir()
+	public1, private1, _ := ed25519.GenerateKey(nil)
+	public2, _, _ := ed25519.GenerateKey(nil)
+
+	der, _ := x509.MarshalPKCS8PrivateKey(private1)
+	privatePath := filepath.Join(dir, "private.pem")
+	os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	key, err := LoadSignKeyFile(privatePath)
+	if err != nil || !key.Equal(private1) {
+		t.Error(err)
+	}
+
+	var trusted []byte
+	for _, public := range []ed25519.PublicKey{public1, public2} {
+		der, _ = x509.MarshalPKIXPublicKey(public)
+		trusted = append(trusted, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	trustedPath := filepath.Join(dir, "trusted.pem")
+	os.WriteFile(trustedPath, trusted, 0600)
+	keys, err := LoadTrustedKeysFile(trustedPath)
+	if err != nil || len(keys) != 2 || !keys[0].Equal(public1) || !keys[1].Equal(public2) {
+		t.Error(keys, err)
+	}
+
+	if _, err = LoadSignKeyFile(trustedPath); err == nil {
+		t.Error()
+	}
+	if _, err = LoadTrustedKeysFile(privatePath); err == nil {
+		t.Error()
+	}
+}
+
+func TestSignedPatch(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	to := &Device{Id: 2, Blocks: BlockArr{{OriginOffset: 0, DataOffset: 0, Length: 100}}}
+	public, private, _ := ed25519.GenerateKey(nil)
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+
+	writePatch := func(opts WriteOptions) []byte {
+		buf := &bytes.Buffer{}
+		err := WritePatch(context.Background(), buf, bytes.NewReader(data), Diff(nil, to), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	signed := writePatch(WriteOptions{FromDevId: NONE_DEV_ID, ToDevId: 2, Size: 100, SignKey: private})
+	unsigned := writePatch(WriteOptions{FromDevId: NONE_DEV_ID, ToDevId: 2, Size: 100})
+
+	err := VerifyPatch(context.Background(), bytes.NewReader(signed), VerifyOptions{TrustedKeys: []ed25519.PublicKey{otherPublic, public}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = VerifyPatch(context.Background(), bytes.NewReader(signed), VerifyOptions{TrustedKeys: []ed25519.PublicKey{otherPublic}})
+	if exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+	err = VerifyPatch(context.Background(), bytes.NewReader(unsigned), VerifyOptions{TrustedKeys: []ed25519.PublicKey{public}})
+	if exitCode(err) != EXIT_PATCH {
+		t.Error(err)
+	}
+
+	// Signature from other patch
+	trailer := patchTrailer{Sum: [32]byte{1}}
+	trailer.Signature = signPatchSum(private, [32]byte{2})
+	if checkPatchSignature(trailer, []ed25519.PublicKey{public}) == nil {
+		t.Error()
+	}
+}
@@ -0,0 +1,188 @@
+package lvm_thin_diff
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Source of device blocks, ordered by origin offset. It used for diff devices without load all mappings to memory.
+type BlockSource interface {
+	// Return next block. ok is false when blocks are over.
+	Next() (block Block, ok bool, err error)
+}
+
+type blockArrSource struct {
+	arr BlockArr
+}
+
+// BlockSource over blocks of arr, which must be sorted by origin offset
+func (arr BlockArr) Source() BlockSource {
+	return &blockArrSource{arr: arr}
+}
+
+func (this *blockArrSource) Next() (block Block, ok bool, err error) {
+	if len(this.arr) == 0 {
+		return block, false, nil
+	}
+	block = this.arr[0]
+	this.arr = this.arr[1:]
+	return block, true, nil
+}
+
+// Streaming reader of mappings of requested devices from thin_dump xml. Other devices are skipped.
+type xmlMappingScanner struct {
+	BlockSize int64 // data block size, bytes
+	Seen      []int // dev_ids of all devices, which readed from stream
+
+	xmlReader *xml.Decoder
+	devIds    []int
+	devId     int // dev_id of current device
+	inDevice  bool
+	end       bool
+}
+
+// Read xml to superblock start
+func newXMLMappingScanner(reader io.Reader, devIds ...int) (*xmlMappingScanner, error) {
+	res := &xmlMappingScanner{xmlReader: xml.NewDecoder(reader), devIds: devIds}
+	for {
+		token, err := res.xmlReader.Token()
+		if err != nil {
+			return nil, errors.New("Parse token error: " + err.Error())
+		}
+		t, ok := token.(xml.StartElement)
+		if !ok || t.Name.Local != "superblock" {
+			continue
+		}
+		res.BlockSize, err = strconv.ParseInt(getAttr(t.Attr, "data_block_size"), 10, 64)
+		if err != nil {
+			return nil, errors.New("Can't parse blockSize: " + err.Error())
+		}
+		res.BlockSize *= sectorSize
+		return res, nil
+	}
+}
+
+// Return next mapping of requested devices. ok is false after end of superblock.
+func (this *xmlMappingScanner) Next() (devId int, block Block, ok bool, err error) {
+	for !this.end {
+		token, err := this.xmlReader.Token()
+		if err != nil {
+			return 0, block, false, errors.New("Parse token error: " + err.Error())
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "device":
+				id, err := strconv.Atoi(getAttr(t.Attr, "dev_id"))
+				if err != nil {
+					return 0, block, false, errors.New("Can't parse device id: " + getAttr(t.Attr, "dev_id"))
+				}
+				this.Seen = append(this.Seen, id)
+				if !containsInt(this.devIds, id) {
+					err = this.xmlReader.Skip()
+					if err != nil {
+						return 0, block, false, errors.New("Parse token error: " + err.Error())
+					}
+					continue
+				}
+				this.devId = id
+				this.inDevice = true
+			case "single_mapping", "range_mapping":
+				if !this.inDevice {
+					return 0, block, false, errors.New("Mapping outside of device")
+				}
+				block, err = parseMapping(t, this.BlockSize)
+				if err != nil {
+					return 0, block, false, err
+				}
+				return this.devId, block, true, nil
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "device":
+				this.inDevice = false
+			case "superblock":
+				this.end = true
+			}
+		}
+	}
+	return 0, block, false, nil
+}
+
+// Return DeviceNotFoundError if device wasn't readed from stream. NONE_DEV_ID is always found.
+func (this *xmlMappingScanner) checkSeen(devId int) error {
+	if devId == NONE_DEV_ID || containsInt(this.Seen, devId) {
+		return nil
+	}
+	available := append([]int(nil), this.Seen...)
+	sort.Ints(available)
+	return &DeviceNotFoundError{Id: devId, Available: available}
+}
+
+// Streaming BlockSource of one device from thin_dump xml. Memory usage doesn't depend on count of mappings.
+type XMLBlockSource struct {
+	DevId     int
+	BlockSize int64 // data block size, bytes
+
+	scanner *xmlMappingScanner
+	last    int64 // origin end of previous block
+}
+
+// Read xml to superblock start. NONE_DEV_ID mean empty device, its source hasn't blocks.
+func NewXMLBlockSource(reader io.Reader, devId int) (*XMLBlockSource, error) {
+	scanner, err := newXMLMappingScanner(reader, devId)
+	if err != nil {
+		return nil, err
+	}
+	return &XMLBlockSource{DevId: devId, BlockSize: scanner.BlockSize, scanner: scanner}, nil
+}
+
+func (this *XMLBlockSource) Next() (block Block, ok bool, err error) {
+	if this.DevId == NONE_DEV_ID {
+		return block, false, nil
+	}
+	_, block, ok, err = this.scanner.Next()
+	if err != nil {
+		return block, false, err
+	}
+	if !ok {
+		return block, false, this.scanner.checkSeen(this.DevId)
+	}
+	if block.OriginOffset < this.last {
+		return block, false, fmt.Errorf("Mappings of device %v aren't sorted by origin offset: %v after %v", this.DevId, block.OriginOffset, this.last)
+	}
+	this.last = block.OriginLast()
+	return block, true, nil
+}
+
+// End of last mapped block of every requested device, by one pass over thin_dump xml.
+// Return DeviceNotFoundError if some of devices doesn't exist. NONE_DEV_ID mean empty device.
+func XMLDevicesEnd(reader io.Reader, devIds ...int) (map[int]int64, error) {
+	scanner, err := newXMLMappingScanner(reader, devIds...)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int]int64)
+	for {
+		devId, block, ok, err := scanner.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if last := block.OriginLast(); last > res[devId] {
+			res[devId] = last
+		}
+	}
+	for _, devId := range devIds {
+		if err = scanner.checkSeen(devId); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,152 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const streamTestXML = `<superblock uuid="" time="5" transaction="17" data_block_size="128" nr_data_blocks="0">
+  <device dev_id="1" mapped_blocks="4" transaction="0" creation_time="0" snap_time="0">
+    <single_mapping origin_block="0" data_block="0" time="0"/>
+    <range_mapping origin_begin="1" data_begin="10" length="4" time="0"/>
+    <single_mapping origin_block="8" data_block="20" time="0"/>
+  </device>
+  <device dev_id="3" mapped_blocks="1" transaction="0" creation_time="0" snap_time="0">
+    <single_mapping origin_block="100" data_block="100" time="0"/>
+  </device>
+  <device dev_id="2" mapped_blocks="5" transaction="1" creation_time="1" snap_time="1">
+    <range_mapping origin_begin="0" data_begin="0" length="2" time="0"/>
+    <range_mapping origin_begin="2" data_begin="30" length="2" time="1"/>
+    <single_mapping origin_block="10" data_block="31" time="1"/>
+  </device>
+</superblock>
+`
+
+func readAllBlocks(t *testing.T, src BlockSource) (res BlockArr) {
+	for {
+		block, ok, err := src.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return res
+		}
+		res = append(res, block)
+	}
+}
+
+func TestParseMetadataSkip(t *testing.T) {
+	pool, err := ParseMetadata(bytes.NewBufferString(streamTestXML), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Devices) != 1 || pool.Devices[0].Id != 2 || len(pool.Devices[0].Blocks) != 3 {
+		t.Errorf("%#v", pool.Devices)
+	}
+	if !reflect.DeepEqual(pool.Skipped, []int{1, 3}) {
+		t.Error(pool.Skipped)
+	}
+	if _, err = pool.Device(1); err == nil {
+		t.Error()
+	}
+	var notFound *DeviceNotFoundError
+	if _, err = pool.Device(5); !errors.As(err, &notFound) || !reflect.DeepEqual(notFound.Available, []int{1, 2, 3}) {
+		t.Error(err)
+	}
+}
+
+func TestXMLBlockSource(t *testing.T) {
+	pool, err := ParseMetadata(bytes.NewBufferString(streamTestXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2, 3} {
+		src, err := NewXMLBlockSource(bytes.NewBufferString(streamTestXML), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.BlockSize != pool.BlockSize {
+			t.Error(src.BlockSize)
+		}
+		dev, _ := pool.Device(id)
+		if blocks := readAllBlocks(t, src); !reflect.DeepEqual(blocks, dev.Blocks) {
+			t.Errorf("%v: %#v", id, blocks)
+		}
+	}
+
+	src, err := NewXMLBlockSource(bytes.NewBufferString(streamTestXML), NONE_DEV_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := readAllBlocks(t, src); len(blocks) != 0 {
+		t.Error(blocks)
+	}
+
+	src, err = NewXMLBlockSource(bytes.NewBufferString(streamTestXML), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notFound *DeviceNotFoundError
+	if _, _, err = src.Next(); !errors.As(err, &notFound) || !reflect.DeepEqual(notFound.Available, []int{1, 2, 3}) {
+		t.Error(err)
+	}
+
+	unsorted := `<superblock data_block_size="128"><device dev_id="1">
+<single_mapping origin_block="5" data_block="0"/><single_mapping origin_block="4" data_block="1"/>
+</device></superblock>`
+	src, err = NewXMLBlockSource(bytes.NewBufferString(unsorted), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Next()
+	if _, _, err = src.Next(); err == nil {
+		t.Error()
+	}
+}
+
+func TestDiffSources(t *testing.T) {
+	pool, err := ParseMetadata(bytes.NewBufferString(streamTestXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, _ := pool.Device(1)
+	to, _ := pool.Device(2)
+	fromSrc, err := NewXMLBlockSource(bytes.NewBufferString(streamTestXML), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toSrc, err := NewXMLBlockSource(bytes.NewBufferString(streamTestXML), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readAllChanges(t, Coalesce(Diff(from, to)))
+	changes := readAllChanges(t, Coalesce(DiffSources(fromSrc, toSrc)))
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("%#v\n%#v", changes, expected)
+	}
+
+	toSrc, _ = NewXMLBlockSource(bytes.NewBufferString(streamTestXML), 2)
+	expected = readAllChanges(t, Diff(nil, to))
+	changes = readAllChanges(t, DiffSources(nil, toSrc))
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("%#v\n%#v", changes, expected)
+	}
+}
+
+func TestXMLDevicesEnd(t *testing.T) {
+	const blockSize = 128 * 512
+	ends, err := XMLDevicesEnd(bytes.NewBufferString(streamTestXML), 1, 2, NONE_DEV_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ends, map[int]int64{1: 9 * blockSize, 2: 11 * blockSize}) {
+		t.Error(ends)
+	}
+
+	var notFound *DeviceNotFoundError
+	if _, err = XMLDevicesEnd(bytes.NewBufferString(streamTestXML), 1, 5); !errors.As(err, &notFound) || notFound.Id != 5 {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+package lvm_thin_diff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Structural problem of thin_dump xml
+type MetadataProblem struct {
+	Line    int // line of xml, where problem found
+	Message string
+}
+
+func (this MetadataProblem) String() string {
+	return fmt.Sprintf("line %v: %v", this.Line, this.Message)
+}
+
+// Metadata has structural problems, it can't be used for diff
+type InvalidMetadataError struct {
+	Problems []MetadataProblem
+}
+
+func (this *InvalidMetadataError) Error() string {
+	const maxProblems = 5 // problems in message, other are only counted
+	problems := make([]string, 0, maxProblems)
+	for i := 0; i < len(this.Problems) && i < maxProblems; i++ {
+		problems = append(problems, this.Problems[i].String())
+	}
+	res := fmt.Sprintf("Invalid metadata, %v problems: %v", len(this.Problems), strings.Join(problems, "; "))
+	if len(this.Problems) > maxProblems {
+		res += "; ..."
+	}
+	return res
+}
+
+/*
+Check structure of thin_dump xml by one pass:
+mappings must be inside device, devices inside superblock, dev_ids must be unique, mappings of device must be sorted
+by origin offset without overlaps and placed inside data device (nr_data_blocks of superblock, 0 mean unknown size).
+Return all found problems. Error returned only if xml can't be readed.
+Memory usage depend on count of devices, but not on count of mappings.
+*/
+func ValidateMetadata(reader io.Reader) ([]MetadataProblem, error) {
+	xmlReader := xml.NewDecoder(reader)
+	var problems []MetadataProblem
+	var line int
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, MetadataProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var blockSize, dataSize int64 // bytes, 0 if unknown
+	var inSuperblock, inDevice bool
+	var devId int
+	var lastOrigin int64          // origin end of previous mapping of current device
+	devLines := make(map[int]int) // dev_id -> line of device definition
+
+	for {
+		token, err := xmlReader.Token()
+		line, _ = xmlReader.InputPos()
+		if err == io.EOF {
+			if inSuperblock {
+				addProblem("Unexpected end of metadata, superblock isn't closed")
+			}
+			return problems, nil
+		}
+		if err != nil {
+			return problems, fmt.Errorf("Parse token error at line %v: %v", line, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "superblock":
+				if inSuperblock {
+					addProblem("Nested superblock")
+				}
+				inSuperblock = true
+				blockSize, err = strconv.ParseInt(getAttr(t.Attr, "data_block_size"), 10, 64)
+				if err != nil || blockSize <= 0 {
+					addProblem("Bad data_block_size: '%v'", getAttr(t.Attr, "data_block_size"))
+					blockSize = 0
+				}
+				blockSize *= sectorSize
+				dataSize = 0
+				if nrDataBlocks := getAttr(t.Attr, "nr_data_blocks"); nrDataBlocks != "" {
+					blocks, err := strconv.ParseInt(nrDataBlocks, 10, 64)
+					if err != nil || blocks < 0 {
+						addProblem("Bad nr_data_blocks: '%v'", nrDataBlocks)
+					}
+					dataSize = blocks * blockSize
+				}
+			case "device":
+				if !inSuperblock {
+					addProblem("Device outside of superblock")
+				}
+				if inDevice {
+					addProblem("Nested device")
+				}
+				inDevice = true
+				lastOrigin = 0
+				devId, err = strconv.Atoi(getAttr(t.Attr, "dev_id"))
+				if err != nil {
+					addProblem("Bad dev_id: '%v'", getAttr(t.Attr, "dev_id"))
+					continue
+				}
+				if firstLine, ok := devLines[devId]; ok {
+					addProblem("Duplicate dev_id %v, first defined at line %v", devId, firstLine)
+				} else {
+					devLines[devId] = line
+				}
+			case "single_mapping", "range_mapping":
+				if blockSize == 0 {
+					addProblem("Mapping before superblock with data_block_size")
+					continue
+				}
+				if !inDevice {
+					addProblem("Mapping outside of device")
+					continue
+				}
+				block, err := parseMapping(t, blockSize)
+				if err != nil {
+					addProblem("%v", err)
+					continue
+				}
+				if block.OriginOffset < 0 || block.DataOffset < 0 || block.Length <= 0 {
+					addProblem("Bad mapping range of device %v", devId)
+					continue
+				}
+				if block.OriginOffset < lastOrigin {
+					addProblem("Mapping of device %v overlaps previous mapping or isn't sorted by origin: block %v before end of previous mapping %v",
+						devId, block.OriginOffset/blockSize, lastOrigin/blockSize)
+				}
+				if block.OriginLast() > lastOrigin {
+					lastOrigin = block.OriginLast()
+				}
+				if dataSize > 0 && block.DataOffset+block.Length > dataSize {
+					addProblem("Mapping of device %v beyond end of data device: data block %v, nr_data_blocks %v",
+						devId, (block.DataOffset+block.Length)/blockSize-1, dataSize/blockSize)
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "device":
+				inDevice = false
+			case "superblock":
+				inSuperblock = false
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	problems, err := ValidateMetadata(bytes.NewBufferString(streamTestXML))
+	if err != nil || len(problems) != 0 {
+		t.Error(problems, err)
+	}
+
+	data := `<single_mapping origin_block="0" data_block="0"/>
+<superblock data_block_size="128" nr_data_blocks="100">
+<single_mapping origin_block="0" data_block="0"/>
+<device dev_id="1">
+  <single_mapping origin_block="0" data_block="0"/>
+  <range_mapping origin_begin="1" data_begin="1" length="4"/>
+  <single_mapping origin_block="3" data_block="10"/>
+  <single_mapping origin_block="10" data_block="100"/>
+</device>
+<device dev_id="1">
+</device>
+<device dev_id="x"/>
+</superblock>
+`
+	problems, err = ValidateMetadata(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, problem := range problems {
+		lines = append(lines, problem.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{1, 3, 7, 8, 10, 12}) {
+		t.Error(problems)
+	}
+	if !strings.Contains(problems[4].Message, "line 4") {
+		t.Error(problems[4])
+	}
+
+	_, err = ValidateMetadata(bytes.NewBufferString(`<superblock data_block_size="128"><device>`))
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestParseInvalidMetadata(t *testing.T) {
+	for _, data := range []string{
+		`<single_mapping origin_block="0" data_block="0"/>`,
+		`<superblock data_block_size="128"><single_mapping origin_block="0" data_block="0"/></superblock>`,
+		`<superblock data_block_size="128"><device dev_id="1"/><single_mapping origin_block="0" data_block="0"/></superblock>`,
+	} {
+		if _, err := parseMetaDataXML(bytes.NewBufferString(data)); err == nil {
+			t.Error(data)
+		}
+	}
+}
+
+func TestInvalidMetadataError(t *testing.T) {
+	err := &InvalidMetadataError{Problems: []MetadataProblem{{Line: 1, Message: "a"}, {Line: 2, Message: "b"}}}
+	if err.Error() != "Invalid metadata, 2 problems: line 1: a; line 2: b" {
+		t.Error(err)
+	}
+}
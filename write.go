@@ -0,0 +1,250 @@
+package lvm_thin_diff
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+)
+
+type WriteOptions struct {
+	BlockSize int64              // data block size of thin pool, bytes. Stored in patch header.
+	FromDevId int                // DevID of base snapshot, NONE_DEV_ID for empty base
+	ToDevId   int                // DevID of new snapshot
+	Size      int64              // origin device size, bytes. Patch can't be applied to smaller device.
+	BufSize   int                // max size of data buffer in patch, BUF_SIZE if 0
+	Codec     string             // name of registered codec for compress data, empty for uncompressed patch. See RegisterCodec.
+	Key       *Key               // key for encrypt data, nil for unencrypted patch
+	SignKey   ed25519.PrivateKey // key for sign patch, nil for unsigned patch
+
+	// Save origin ranges of unchanged shared data to patch summary, else only their count and size are saved
+	SharedRanges bool
+
+	// Write ZERO records without data instead of WRITE for data buffers, which contain only zeros. Data is read ahead
+	// by detectZeroWindow buffers for write runs of non-zero buffers by one WRITE record.
+	DetectZero bool
+
+	// Compare data of from and to blocks of WRITE changes by BlockSize units and doesn't write equal units.
+	CompareContent bool
+}
+
+// Destination of patch records: stream or indexed patch writer
+type recordWriter interface {
+	WritePatch(patch Patch) error
+	WriteData(buf []byte) error // data of last WRITE record, buffers in origin order
+	AddShared(blocks BlockArr)  // unchanged blocks of NONE change
+	Close() error
+}
+
+// Write patch stream with changes from iter. Data for WRITE changes read from data - pool data device.
+// Doesn't close writer.
+func WritePatch(ctx context.Context, writer io.Writer, data io.ReaderAt, iter Iterator, opts WriteOptions) error {
+	header, err := newWriteHeader(opts)
+	if err != nil {
+		return err
+	}
+	patchWriter, err := newPatchWriter(writer, header, opts.Key)
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	patchWriter.signKey = opts.SignKey
+	patchWriter.saveShared = opts.SharedRanges
+	return writeRecords(ctx, patchWriter, data, iter, opts)
+}
+
+func newWriteHeader(opts WriteOptions) (patchHeader, error) {
+	header := newPatchHeader(opts.BlockSize, opts.FromDevId, opts.ToDevId, opts.Size)
+	header.Codec = opts.Codec
+	if _, err := getCodec(header.Codec); err != nil {
+		return header, &UsageError{Message: err.Error()}
+	}
+	return header, nil
+}
+
+// Data buffers, which read ahead with DetectZero: window of detectZeroWindow buffers
+const detectZeroWindow = 4
+
+// Write records and data of changes from iter by patchWriter and close it
+func writeRecords(ctx context.Context, patchWriter recordWriter, data io.ReaderAt, iter Iterator, opts WriteOptions) error {
+	bufSize := int64(opts.BufSize)
+	if bufSize == 0 {
+		bufSize = BUF_SIZE
+	}
+	if opts.CompareContent {
+		iter = Coalesce(CompareContent(iter, data, opts.BlockSize))
+	}
+
+	buf := make([]byte, bufSize)
+	var detector *zeroDetector
+	if opts.DetectZero {
+		detector = &zeroDetector{writer: patchWriter, window: make([]byte, bufSize*detectZeroWindow), zero: Patch{Operation: ZERO}}
+	}
+	for {
+		change, ok, err := iter.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if change.Operation == NONE {
+			patchWriter.AddShared(change.To)
+			continue
+		}
+		if change.Offset+change.Length > opts.Size {
+			return &UsageError{Message: fmt.Sprintf("Change at offset %v, length %v out of device size %v", change.Offset, change.Length, opts.Size)}
+		}
+		if change.Operation == WRITE && opts.DetectZero {
+			err = detector.writeChange(ctx, data, change, bufSize)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = patchWriter.WritePatch(change.Patch)
+		if err != nil {
+			return &OutputWriteError{Err: err}
+		}
+		if change.Operation != WRITE {
+			continue
+		}
+
+		for _, block := range change.To {
+			var writedBytes int64
+			for writedBytes < block.Length {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				localBuf := buf[:minInt64(bufSize, block.Length-writedBytes)]
+				_, err = data.ReadAt(localBuf, block.DataOffset+writedBytes)
+				if err != nil {
+					return &DataReadError{Err: err}
+				}
+				writedBytes += int64(len(localBuf))
+				err = patchWriter.WriteData(localBuf)
+				if err != nil {
+					return &OutputWriteError{Err: err}
+				}
+			}
+		}
+	}
+
+	err := patchWriter.Close()
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
+
+// Data buffer in window of zeroDetector
+type dataPiece struct {
+	offset int64 // origin offset
+	buf    []byte
+	zero   bool
+}
+
+/*
+Writer of WRITE changes with DetectZero. Data is read ahead by window of buffers: every run of contiguous non-zero
+buffers in window is written by one WRITE record, buffers with zeros are merged to ZERO records.
+*/
+type zeroDetector struct {
+	writer recordWriter
+	window []byte
+	pieces []dataPiece // buffers in window, in origin order
+	used   int64       // used bytes of window
+	zero   Patch       // ZERO record, which not written yet
+}
+
+func (this *zeroDetector) writeChange(ctx context.Context, data io.ReaderAt, change Change, bufSize int64) error {
+	for _, block := range change.To {
+		var readedBytes int64
+		for readedBytes < block.Length {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			size := minInt64(bufSize, block.Length-readedBytes)
+			if this.used+size > int64(len(this.window)) {
+				if err := this.flushWindow(); err != nil {
+					return err
+				}
+			}
+			buf := this.window[this.used : this.used+size]
+			_, err := data.ReadAt(buf, block.DataOffset+readedBytes)
+			if err != nil {
+				return &DataReadError{Err: err}
+			}
+			this.pieces = append(this.pieces, dataPiece{offset: block.OriginOffset + readedBytes, buf: buf, zero: isZero(buf)})
+			this.used += size
+			readedBytes += size
+		}
+	}
+	if err := this.flushWindow(); err != nil {
+		return err
+	}
+	return this.flushZero()
+}
+
+// Write records for buffers of window. Last ZERO record isn't written, it may be continued by next window.
+func (this *zeroDetector) flushWindow() error {
+	pieces := this.pieces
+	for i := 0; i < len(pieces); {
+		piece := pieces[i]
+		if piece.zero {
+			if this.zero.Length > 0 && this.zero.Offset+this.zero.Length != piece.offset {
+				if err := this.flushZero(); err != nil {
+					return err
+				}
+			}
+			if this.zero.Length == 0 {
+				this.zero.Offset = piece.offset
+			}
+			this.zero.Length += int64(len(piece.buf))
+			i++
+			continue
+		}
+		if err := this.flushZero(); err != nil {
+			return err
+		}
+
+		length := int64(len(piece.buf))
+		next := i + 1
+		for ; next < len(pieces) && !pieces[next].zero && pieces[next].offset == piece.offset+length; next++ {
+			length += int64(len(pieces[next].buf))
+		}
+		err := this.writer.WritePatch(Patch{Operation: WRITE, Offset: piece.offset, Length: length})
+		if err != nil {
+			return &OutputWriteError{Err: err}
+		}
+		for ; i < next; i++ {
+			err = this.writer.WriteData(pieces[i].buf)
+			if err != nil {
+				return &OutputWriteError{Err: err}
+			}
+		}
+	}
+	this.pieces = this.pieces[:0]
+	this.used = 0
+	return nil
+}
+
+func (this *zeroDetector) flushZero() error {
+	if this.zero.Length == 0 {
+		return nil
+	}
+	err := this.writer.WritePatch(this.zero)
+	this.zero = Patch{Operation: ZERO}
+	if err != nil {
+		return &OutputWriteError{Err: err}
+	}
+	return nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
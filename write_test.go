@@ -0,0 +1,223 @@
+package lvm_thin_diff
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Content of device with data from pool data device
+func deviceImage(data []byte, dev *Device, size int64) []byte {
+	res := make([]byte, size)
+	for _, block := range dev.Blocks {
+		copy(res[block.OriginOffset:block.OriginLast()], data[block.DataOffset:block.DataOffset+block.Length])
+	}
+	return res
+}
+
+// Data device of tests: first 500 bytes aren't zero, other are zero
+func testData() []byte {
+	data := make([]byte, 1000)
+	for i := range data[:500] {
+		data[i] = byte(i%255 + 1)
+	}
+	return data
+}
+
+// Base and new snapshots of tests on testData
+func testDevices() (from, to *Device) {
+	from = &Device{Id: 1, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 100},
+		{OriginOffset: 200, DataOffset: 100, Length: 100},
+	}}
+	to = &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 100},
+		{OriginOffset: 100, DataOffset: 300, Length: 50},
+		{OriginOffset: 150, DataOffset: 600, Length: 50},
+	}}
+	return from, to
+}
+
+func TestWritePatch(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	from := &Device{Id: 1, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 100},
+		{OriginOffset: 200, DataOffset: 100, Length: 100},
+		{OriginOffset: 400, DataOffset: 200, Length: 50},
+	}}
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 50},
+		{OriginOffset: 50, DataOffset: 500, Length: 100},
+		{OriginOffset: 400, DataOffset: 200, Length: 50},
+		{OriginOffset: 450, DataOffset: 700, Length: 50},
+	}}
+	const size = 500
+
+	buf := &bytes.Buffer{}
+	opts := WriteOptions{BlockSize: 50, FromDevId: 1, ToDevId: 2, Size: size, BufSize: 30}
+	err := WritePatch(context.Background(), buf, bytes.NewReader(data), Diff(from, to), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := memWriterAt(deviceImage(data, from, size))
+	deleteRange := func(offset, length int64) error {
+		return zeroRange(target, offset, length)
+	}
+	err = ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: 1, TargetSize: size, DeleteRange: deleteRange})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(target, deviceImage(data, to, size)) {
+		t.Error()
+	}
+
+	// Coalesced
+	buf.Reset()
+	err = WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(from, to)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target = memWriterAt(deviceImage(data, from, size))
+	err = ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: 1, TargetSize: size, DeleteRange: deleteRange})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(target, deviceImage(data, to, size)) {
+		t.Error()
+	}
+
+	// Compressed
+	for _, codec := range []string{"gzip", "zlib", "flate"} {
+		buf.Reset()
+		opts.Codec = codec
+		err = WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(from, to)), opts)
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		target = memWriterAt(deviceImage(data, from, size))
+		err = ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: 1, TargetSize: size, DeleteRange: deleteRange})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		if !bytes.Equal(target, deviceImage(data, to, size)) {
+			t.Error(codec)
+		}
+	}
+	opts.Codec = "test"
+	err = WritePatch(context.Background(), &bytes.Buffer{}, bytes.NewReader(data), Diff(from, to), opts)
+	if exitCode(err) != EXIT_USAGE {
+		t.Error(err)
+	}
+	opts.Codec = ""
+
+	// Short data device
+	err = WritePatch(context.Background(), &bytes.Buffer{}, bytes.NewReader(data[:600]), Diff(from, to), opts)
+	if exitCode(err) != EXIT_DATA_READ {
+		t.Error(err)
+	}
+
+	// Change out of device size
+	opts.Size = size - 1
+	err = WritePatch(context.Background(), &bytes.Buffer{}, bytes.NewReader(data), Diff(from, to), opts)
+	if exitCode(err) != EXIT_USAGE {
+		t.Error(err)
+	}
+}
+
+func TestWritePatchDetectZero(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data[100:200] {
+		data[100+i] = byte(i + 1)
+	}
+	to := &Device{Id: 2, Blocks: BlockArr{
+		{OriginOffset: 0, DataOffset: 0, Length: 150},
+		{OriginOffset: 150, DataOffset: 200, Length: 50},
+		{OriginOffset: 200, DataOffset: 100, Length: 100},
+	}}
+	const size = 300
+
+	buf := &bytes.Buffer{}
+	opts := WriteOptions{BlockSize: 50, FromDevId: NONE_DEV_ID, ToDevId: 2, Size: size, BufSize: 50, DetectZero: true}
+	err := WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(nil, to)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patchReader, err := newPatchReader(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []Patch
+	for {
+		patch, err := patchReader.Next()
+		if err != nil {
+			break
+		}
+		records = append(records, patch)
+		if patch.Operation == WRITE {
+			patchReader.ReadData(patch, func(int64, []byte) error { return nil })
+		}
+	}
+	expected := []Patch{
+		{Operation: ZERO, Offset: 0, Length: 100},
+		{Operation: WRITE, Offset: 100, Length: 50},
+		{Operation: ZERO, Offset: 150, Length: 50},
+		{Operation: WRITE, Offset: 200, Length: 100},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("%#v", records)
+	}
+
+	target := memWriterAt(bytes.Repeat([]byte{7}, size))
+	err = ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(target, deviceImage(data, to, size)) {
+		t.Error()
+	}
+}
+
+func TestWritePatchDetectZeroRecords(t *testing.T) {
+	// Contiguous origin blocks with fragmented data
+	data := bytes.Repeat([]byte{1}, 100*10)
+	to := &Device{Id: 2}
+	for i := int64(0); i < 50; i++ {
+		to.Blocks = append(to.Blocks, Block{OriginOffset: i * 10, DataOffset: (99 - i*2) * 10, Length: 10})
+	}
+	const size = 500
+
+	for _, test := range []struct {
+		bufSize int
+		writes  int
+	}{
+		{0, 1},
+		{40, 4}, // window of 160 bytes
+		{500, 1},
+	} {
+		buf := &bytes.Buffer{}
+		opts := WriteOptions{BlockSize: 10, FromDevId: NONE_DEV_ID, ToDevId: 2, Size: size, BufSize: test.bufSize, DetectZero: true}
+		err := WritePatch(context.Background(), buf, bytes.NewReader(data), Coalesce(Diff(nil, to)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := InspectPatch(context.Background(), bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := info.Operations["WRITE"]; stats.Count != int64(test.writes) || stats.Bytes != size {
+			t.Error(test.bufSize, stats)
+		}
+
+		target := make(memWriterAt, size)
+		err = ApplyPatch(context.Background(), buf, target, ApplyOptions{FromDevId: NONE_DEV_ID, TargetSize: size})
+		if err != nil || !bytes.Equal(target, deviceImage(data, to, size)) {
+			t.Error(test.bufSize, err)
+		}
+	}
+}